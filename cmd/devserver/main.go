@@ -0,0 +1,113 @@
+// Command devserver runs the bot locally behind net/http, with an in-memory
+// queue standing in for SQS, so it can be debugged without deploying:
+//
+//	CONFIG_JSON="$(cat config.json)" go run ./cmd/devserver [-fixtures service/testdata/fixtures] [-fake-slack]
+//
+// Point a tunnel (ngrok or similar) at it to take real Slack traffic, or
+// replay payloads captured from a user report:
+//
+//	go run ./cmd/devserver -config config.json -fake-slack -replay payloads/
+//
+// Every inbound request and outbound call is logged, and metrics are
+// served in the Prometheus format at /metrics.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+
+	"github.com/yemble/slack-instagram/service"
+	"github.com/yemble/slack-instagram/slacktest"
+)
+
+func main() {
+	var (
+		addr       = flag.String("addr", "localhost:8080", "address to listen on")
+		configPath = flag.String("config", os.Getenv("CONFIG_FILE"), "config file, under CONFIG_JSON and env overrides")
+		fixtures   = flag.String("fixtures", "", "answer instagram fetches from the fixture cassettes in this directory")
+		fakeSlack  = flag.Bool("fake-slack", false, "send slack api calls and response_url posts to a local fake instead of slack")
+		replayPath = flag.String("replay", "", "replay the captured payload file, or directory of files, then exit")
+		deliver    = flag.Duration("deliver", time.Second, "how often queued messages are handed to the handler")
+		schedule   = flag.Duration("schedule", time.Minute, "how often periodic jobs are checked; 0 disables them")
+	)
+	flag.Parse()
+
+	cfg, err := service.LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Loading config: %s", err)
+	}
+
+	rt := &devTransport{next: http.DefaultTransport}
+
+	if *fixtures != "" {
+		player, n, err := loadFixtures(*fixtures)
+		if err != nil {
+			log.Fatalf("Loading fixtures: %s", err)
+		}
+		rt.instagram = player
+		log.Printf("Answering instagram fetches from %d fixtures in %s", n, *fixtures)
+	}
+
+	if *fakeSlack {
+		fake := slacktest.NewServer()
+		defer fake.Close()
+		rt.fakeSlack = fake
+		log.Printf("Sending slack calls to a fake at %s", fake.URL)
+	}
+
+	// only used by a dynamodb store
+	awsSession := session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+
+	store, err := service.NewStore(cfg.Store, awsSession)
+	if err != nil {
+		log.Fatalf("Creating store: %s", err)
+	}
+
+	queue := service.NewMemoryQueue()
+	h := service.NewHandler(cfg, queue, store, service.WithTransport(rt))
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	if *replayPath != "" {
+		if err := replayPayloads(ctx, h, queue, cfg.QueueURL, *replayPath); err != nil {
+			log.Fatalf("Replaying: %s", err)
+		}
+		return
+	}
+
+	go deliverLoop(ctx, h, queue, cfg.QueueURL, *deliver)
+	if *schedule > 0 {
+		go service.RunScheduler(ctx, h, *schedule)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", service.MetricsHandler(h))
+	mux.Handle("/", &invokeHandler{h: h})
+
+	srv := &http.Server{
+		Addr:    *addr,
+		Handler: mux,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdown, done := context.WithTimeout(context.Background(), 5*time.Second)
+		defer done()
+		srv.Shutdown(shutdown)
+	}()
+
+	log.Printf("Listening on http://%s", *addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatalf("Serving: %s", err)
+	}
+}
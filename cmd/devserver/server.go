@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+
+	"github.com/yemble/slack-instagram/service"
+)
+
+// invokeHandler turns http requests into API Gateway events for the
+// handler, the same way they'd arrive on Lambda.
+type invokeHandler struct {
+	h lambda.Handler
+}
+
+func (ih *invokeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	evt := &events.APIGatewayProxyRequest{
+		HTTPMethod:            r.Method,
+		Path:                  r.URL.Path,
+		Headers:               make(map[string]string),
+		QueryStringParameters: make(map[string]string),
+		Body:                  string(body),
+	}
+	for k := range r.Header {
+		evt.Headers[k] = r.Header.Get(k)
+	}
+	for k := range r.URL.Query() {
+		evt.QueryStringParameters[k] = r.URL.Query().Get(k)
+	}
+	if !utf8.Valid(body) {
+		evt.Body = base64.StdEncoding.EncodeToString(body)
+		evt.IsBase64Encoded = true
+	}
+
+	log.Printf("<- %s %s %s", r.Method, r.URL, truncate(string(body), 500))
+
+	payload, err := json.Marshal(evt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	out, err := ih.h.Invoke(r.Context(), payload)
+	if err != nil {
+		log.Printf("<- %s %s failed: %s (%s)", r.Method, r.URL, err, time.Since(start))
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	resp := &events.APIGatewayProxyResponse{}
+	if err := json.Unmarshal(out, resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for k, v := range resp.Headers {
+		w.Header().Set(k, v)
+	}
+	w.WriteHeader(resp.StatusCode)
+	w.Write([]byte(resp.Body))
+
+	log.Printf("<- %s %s: %d %s (%s)", r.Method, r.URL, resp.StatusCode, truncate(resp.Body, 500), time.Since(start))
+}
+
+// deliverLoop hands queued messages to the handler until ctx is done,
+// standing in for the SQS trigger.
+func deliverLoop(ctx context.Context, h lambda.Handler, queue *service.MemoryQueue, queueURL string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deliverOnce(ctx, h, queue, queueURL)
+		}
+	}
+}
+
+func deliverOnce(ctx context.Context, h lambda.Handler, queue *service.MemoryQueue, queueURL string) (delivered, failed int) {
+	delivered, failed, err := queue.Deliver(ctx, h, queueURL)
+	if err != nil {
+		log.Printf("Delivering queued messages: %s", err)
+	}
+	if delivered > 0 {
+		log.Printf("Delivered %d queued messages, %d failed and were requeued", delivered, failed)
+	}
+	return delivered, failed
+}
+
+// replayPayloads invokes the handler with each captured payload at path, in
+// name order, then drains the queue.
+//
+// A payload is either a whole Lambda event, as logged by Lambda, or a raw
+// Slack request body: JSON for events, form encoded for slash commands.
+// Raw bodies are posted to /slack.
+func replayPayloads(ctx context.Context, h lambda.Handler, queue *service.MemoryQueue, queueURL, path string) error {
+	paths := []string{path}
+
+	if fi, err := os.Stat(path); err != nil {
+		return err
+	} else if fi.IsDir() {
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		paths = paths[:0]
+		for _, e := range entries {
+			if !e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+				paths = append(paths, filepath.Join(path, e.Name()))
+			}
+		}
+		sort.Strings(paths)
+	}
+
+	for _, p := range paths {
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		payload, err := replayEvent(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+
+		log.Printf("Replaying %s", p)
+
+		out, err := h.Invoke(ctx, payload)
+		if err != nil {
+			log.Printf("Replaying %s failed: %s", p, err)
+			continue
+		}
+		log.Printf("Replayed %s: %s", p, truncate(string(out), 500))
+
+		// drain what it queued, giving retries a few chances
+		for i := 0; i < 5; i++ {
+			if _, failed := deliverOnce(ctx, h, queue, queueURL); failed == 0 {
+				break
+			}
+		}
+	}
+
+	if n := queue.Len(queueURL); n > 0 {
+		log.Printf("%d messages left on the queue", n)
+	}
+
+	return nil
+}
+
+// replayEvent wraps a captured payload in a Lambda event if it isn't one.
+func replayEvent(data []byte) ([]byte, error) {
+	data = []byte(strings.TrimSpace(string(data)))
+
+	contentType := "application/x-www-form-urlencoded"
+
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(data, &probe); err == nil {
+		for _, k := range []string{"httpMethod", "requestContext", "Records", "detail-type"} {
+			if _, ok := probe[k]; ok {
+				return data, nil
+			}
+		}
+		contentType = "application/json"
+	}
+
+	return json.Marshal(&events.APIGatewayProxyRequest{
+		HTTPMethod: http.MethodPost,
+		Path:       "/slack",
+		Headers:    map[string]string{"Content-Type": contentType},
+		Body:       string(data),
+	})
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "…"
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yemble/slack-instagram/replay"
+	"github.com/yemble/slack-instagram/slacktest"
+)
+
+// devTransport logs outbound calls and routes them to fixtures or the fake
+// slack when those are enabled.
+type devTransport struct {
+	next      http.RoundTripper
+	instagram http.RoundTripper
+	fakeSlack *slacktest.Server
+}
+
+func (t *devTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	orig := req.URL.String()
+
+	next, via := t.next, ""
+	switch {
+	case t.instagram != nil && isInstagramHost(req.URL.Hostname()):
+		next, via = t.instagram, " (fixture)"
+	case t.fakeSlack != nil && isSlackHost(req.URL.Hostname()):
+		req = t.toFakeSlack(req)
+		next, via = t.fakeSlack.Client().Transport, " (fake slack)"
+	}
+
+	resp, err := next.RoundTrip(req)
+	if err != nil {
+		log.Printf("-> %s %s%s: %s (%s)", req.Method, orig, via, err, time.Since(start))
+		return nil, err
+	}
+
+	log.Printf("-> %s %s%s: %s (%s)", req.Method, orig, via, resp.Status, time.Since(start))
+	return resp, nil
+}
+
+// toFakeSlack points a slack api call or response_url post at the fake.
+func (t *devTransport) toFakeSlack(req *http.Request) *http.Request {
+	fake, _ := req.URL.Parse(t.fakeSlack.URL)
+
+	path := req.URL.Path
+	if req.URL.Hostname() == "hooks.slack.com" {
+		path = "/response" + path
+	}
+
+	r := req.Clone(req.Context())
+	r.URL.Scheme = fake.Scheme
+	r.URL.Host = fake.Host
+	r.URL.Path = path
+	r.Host = fake.Host
+	return r
+}
+
+func isInstagramHost(host string) bool {
+	return host == "instagram.com" || strings.HasSuffix(host, ".instagram.com")
+}
+
+func isSlackHost(host string) bool {
+	return host == "slack.com" || strings.HasSuffix(host, ".slack.com")
+}
+
+// loadFixtures combines every cassette in dir into one player.
+func loadFixtures(dir string) (*replay.Player, int, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Strings(paths)
+
+	cassette := &replay.Cassette{}
+	n := 0
+	for _, p := range paths {
+		if filepath.Base(p) == "cases.json" {
+			continue
+		}
+
+		c, err := replay.Load(p)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: %w", p, err)
+		}
+		cassette.Interactions = append(cassette.Interactions, c.Interactions...)
+		n++
+	}
+
+	if n == 0 {
+		return nil, 0, fmt.Errorf("no fixtures in %s", dir)
+	}
+
+	return replay.NewPlayer(cassette), n, nil
+}
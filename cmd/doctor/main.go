@@ -0,0 +1,85 @@
+// Command doctor checks a deployment's config and everything the bot
+// depends on: slack tokens, the queues, the store and instagram sessions.
+// It loads the config the same way the Lambda does:
+//
+//	CONFIG_JSON="$(cat config.json)" go run ./cmd/doctor [-config file]
+//
+// It exits non-zero if anything is wrong.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+
+	"github.com/yemble/slack-instagram/service"
+)
+
+func main() {
+	var (
+		configPath = flag.String("config", os.Getenv("CONFIG_FILE"), "config file, under CONFIG_JSON and env overrides")
+		timeout    = flag.Duration("timeout", time.Minute, "timeout for all checks")
+		verbose    = flag.Bool("v", false, "show the handler's logs")
+	)
+	flag.Parse()
+
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	cfg, err := service.LoadConfig(*configPath)
+	if err != nil {
+		var ce *service.ConfigError
+		if errors.As(err, &ce) {
+			for _, p := range ce.Problems {
+				fmt.Printf("FAIL  config: %s\n", p)
+			}
+		} else {
+			fmt.Printf("FAIL  config: %s\n", err)
+		}
+		os.Exit(1)
+	}
+	fmt.Printf("ok    config\n")
+
+	awsSession := session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+
+	store, err := service.NewStore(cfg.Store, awsSession)
+	if err != nil {
+		fmt.Printf("FAIL  store: %s\n", err)
+		os.Exit(1)
+	}
+
+	h := service.NewHandler(cfg, sqs.New(awsSession), store)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	failed := false
+	for _, c := range service.Doctor(ctx, h) {
+		switch {
+		case c.Err != nil:
+			failed = true
+			fmt.Printf("FAIL  %s: %s\n", c.Name, c.Err)
+		case c.Skipped:
+			fmt.Printf("skip  %s: %s\n", c.Name, c.Detail)
+		case c.Detail != "":
+			fmt.Printf("ok    %s: %s\n", c.Name, c.Detail)
+		default:
+			fmt.Printf("ok    %s\n", c.Name)
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,105 @@
+// Command fixtures re-records the instagram pages used by the extractor
+// tests. Run it from the repository root with a logged in session:
+//
+//	INSTAGRAM_COOKIES='sessionid=...' go run ./cmd/fixtures [-case name]
+//
+// Cases marked synthetic are hand-written pages for made up posts and are
+// skipped. Each recording is run through the extractor with the case's
+// offset, and what it found is logged, to compare with the golden file.
+//
+// Recordings don't include request headers and have Set-Cookie values
+// redacted, but check the pages for anything personal before committing.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/yemble/slack-instagram/replay"
+	"github.com/yemble/slack-instagram/service"
+)
+
+func main() {
+	var (
+		dir       = flag.String("dir", "service/testdata/fixtures", "fixture directory, holding cases.json")
+		only      = flag.String("case", "", "only record this case")
+		userAgent = flag.String("user-agent", "Mozilla/5.0 (X11; Linux x86_64; rv:91.0) Gecko/20100101 Firefox/91.0", "user agent to fetch with")
+	)
+	flag.Parse()
+
+	cookies := os.Getenv("INSTAGRAM_COOKIES")
+	if cookies == "" {
+		log.Printf("INSTAGRAM_COOKIES is not set, recording anonymously")
+	}
+
+	cases, err := replay.LoadCases(filepath.Join(*dir, "cases.json"))
+	if err != nil {
+		log.Fatalf("Loading cases: %s", err)
+	}
+
+	failed := false
+	for _, c := range cases {
+		if *only != "" && c.Name != *only {
+			continue
+		}
+		if c.Synthetic {
+			log.Printf("Skipping synthetic case %s", c.Name)
+			continue
+		}
+
+		if err := record(c, *dir, *userAgent, cookies); err != nil {
+			log.Printf("Recording %s: %s", c.Name, err)
+			failed = true
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func record(c *replay.Case, dir, userAgent, cookies string) error {
+	rec := &replay.Recorder{}
+	client := &http.Client{
+		Transport: rec,
+		Timeout:   30 * time.Second,
+	}
+
+	req, err := http.NewRequest(http.MethodGet, c.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	if !c.Anonymous && cookies != "" {
+		req.Header.Set("Cookie", cookies)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	path := filepath.Join(dir, c.Name+".json")
+	if err := rec.Cassette().Save(path); err != nil {
+		return err
+	}
+
+	log.Printf("Recorded %s (%d) to %s", c.URL, resp.StatusCode, path)
+
+	interactions := rec.Cassette().Interactions
+	body := interactions[len(interactions)-1].Body
+	in := service.InspectHTML(strings.NewReader(body), c.URL, c.Offset)
+	if in.Meta == nil {
+		log.Printf("Extracting %s (offset %d): %s", c.Name, c.Offset, in.Error)
+	} else {
+		log.Printf("Extracted %s (offset %d) with %s: part %d of %d by %s", c.Name, c.Offset, in.Meta.Strategy, in.Meta.PartIndex+1, in.Meta.PartCount, in.Meta.Username)
+	}
+
+	return nil
+}
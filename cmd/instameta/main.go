@@ -0,0 +1,201 @@
+// Command instameta shows what the bot makes of instagram posts, running
+// the same fetch and extraction as the handler:
+//
+//	INSTAGRAM_COOKIES='sessionid=...' go run ./cmd/instameta [-format table] [-render] <url|shortcode|file.html>...
+//
+// Each argument is a post url, a bare shortcode, or a saved page. With
+// -config, the config's sessions, http and render settings are used.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+
+	"github.com/yemble/slack-instagram/service"
+)
+
+type result struct {
+	*service.Inspection
+	Rendered *service.RenderedPost `json:"rendered,omitempty"`
+}
+
+func main() {
+	var (
+		configPath = flag.String("config", os.Getenv("CONFIG_FILE"), "config file, under CONFIG_JSON and env overrides; without either, only $INSTAGRAM_COOKIES is used")
+		format     = flag.String("format", "json", "output format, json or table")
+		render     = flag.Bool("render", false, "include the slack blocks that would be posted")
+		part       = flag.Int("part", 1, "which photo of a carousel, from 1")
+		teamName   = flag.String("team", "", "render with this team's settings")
+		userID     = flag.String("user", "U0123456789", "user id for the slash command headline")
+		timeout    = flag.Duration("timeout", 30*time.Second, "timeout for each post")
+		verbose    = flag.Bool("v", false, "show the handler's logs")
+	)
+	flag.Parse()
+
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	if *format != "json" && *format != "table" {
+		fatalf("unknown format %q", *format)
+	}
+	if flag.NArg() == 0 {
+		fatalf("usage: instameta [flags] <url|shortcode|file.html>...")
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fatalf("loading config: %s", err)
+	}
+
+	var team *service.TeamInfo
+	if *teamName != "" {
+		for _, t := range cfg.SlackTeams {
+			if t.Name == *teamName {
+				team = t
+			}
+		}
+		if team == nil {
+			fatalf("no team named %q in the config", *teamName)
+		}
+	}
+
+	store, _ := service.NewStore(nil, nil)
+	h := service.NewHandler(cfg, nil, store)
+
+	failed := false
+	for _, arg := range flag.Args() {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		r := &result{Inspection: inspect(ctx, h, arg, *part-1)}
+		cancel()
+
+		if r.Meta != nil && *render {
+			r.Rendered = service.RenderPost(cfg, team, *userID, r.Meta)
+		}
+		if r.Error != "" {
+			failed = true
+		}
+
+		if *format == "table" {
+			printTable(os.Stdout, r)
+		} else {
+			printJSON(os.Stdout, r)
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// loadConfig loads the config like the Lambda does, if there is one, and
+// otherwise makes do with INSTAGRAM_COOKIES.
+func loadConfig(path string) (*service.Config, error) {
+	if path == "" && os.Getenv("CONFIG_JSON") == "" {
+		return &service.Config{CookieString: os.Getenv("INSTAGRAM_COOKIES")}, nil
+	}
+
+	cfg, err := service.LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.CookieString == "" {
+		cfg.CookieString = os.Getenv("INSTAGRAM_COOKIES")
+	}
+	return cfg, nil
+}
+
+// inspect treats arg as a url, a saved page, or a shortcode, in that order.
+func inspect(ctx context.Context, h lambda.Handler, arg string, offset int) *service.Inspection {
+	if strings.HasPrefix(arg, "https://") || strings.HasPrefix(arg, "http://") {
+		return service.InspectURL(ctx, h, arg, offset)
+	}
+
+	if f, err := os.Open(arg); err == nil {
+		defer f.Close()
+		return service.InspectHTML(f, arg, offset)
+	}
+
+	return service.InspectURL(ctx, h, fmt.Sprintf("https://www.instagram.com/p/%s/", strings.Trim(arg, "/")), offset)
+}
+
+func printJSON(w io.Writer, r *result) {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	enc.Encode(r)
+}
+
+func printTable(w io.Writer, r *result) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	row := func(k, v string) {
+		if v != "" {
+			fmt.Fprintf(tw, "%s\t%s\n", k, v)
+		}
+	}
+
+	row("url", r.URL)
+	row("error", r.Error)
+	if m := r.Meta; m != nil {
+		row("strategy", m.Strategy)
+		row("username", m.Username)
+		row("title", m.Title)
+		row("caption", oneLine(m.Caption, 100))
+		row("image", m.ImageURL)
+		if m.ImageIsVideo {
+			row("video", "yes")
+		}
+		if m.PartCount > 1 {
+			row("part", fmt.Sprintf("%d of %d", m.PartIndex+1, m.PartCount))
+		}
+		if !m.TakenAt.IsZero() {
+			row("taken at", m.TakenAt.Format(time.RFC3339))
+		}
+	}
+	if r.Truncated {
+		row("truncated", "yes")
+	}
+	row("read", r.ReadTime.String())
+	row("extract", r.ExtractTime.String())
+	for _, s := range r.Strategies {
+		status := "ok"
+		if s.Error != "" {
+			status = s.Error
+		}
+		row("  "+s.Name, fmt.Sprintf("%s (%s)", status, s.Took))
+	}
+	tw.Flush()
+
+	if r.Rendered != nil {
+		fmt.Fprintln(w, "rendered:")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		enc.Encode(r.Rendered)
+	}
+	fmt.Fprintln(w)
+}
+
+func oneLine(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if r := []rune(s); len(r) > n {
+		return string(r[:n-1]) + "…"
+	}
+	return s
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "instameta: "+format+"\n", args...)
+	os.Exit(2)
+}
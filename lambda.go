@@ -14,8 +14,7 @@ import (
 func main() {
 	log.Printf("Starting lambda handler")
 
-	cfgString := os.Getenv("CONFIG_JSON")
-	cfg, err := service.NewConfigFromJSON([]byte(cfgString))
+	cfg, err := service.LoadConfig(os.Getenv("CONFIG_FILE"))
 	if err != nil {
 		log.Fatalf("Loading config: %s", err)
 	}
@@ -24,7 +23,16 @@ func main() {
 		SharedConfigState: session.SharedConfigEnable,
 	}))
 
-	h := service.NewHandler(cfg, sqs.New(awsSession))
+	if cfg.Store == nil {
+		log.Printf("No store configured, keeping state in memory; it's lost on every cold start")
+	}
+
+	store, err := service.NewStore(cfg.Store, awsSession)
+	if err != nil {
+		log.Fatalf("Creating store: %s", err)
+	}
+
+	h := service.NewHandler(cfg, sqs.New(awsSession), store, service.WithEMF(os.Stdout))
 
 	lambda.StartHandler(h)
 
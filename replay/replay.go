@@ -0,0 +1,206 @@
+// Package replay records http exchanges to files and plays them back, so
+// tests can run against real responses without the network.
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Interaction is one recorded request and its response.
+type Interaction struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body"`
+}
+
+// Cassette is a sequence of interactions, usually one fetch and any
+// redirects it followed.
+type Cassette struct {
+	Interactions []*Interaction `json:"interactions"`
+}
+
+// Load reads a cassette from a file written by Save.
+func Load(path string) (*Cassette, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Cassette{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Save writes the cassette to path.
+func (c *Cassette) Save(path string) error {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(c); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// Player is a RoundTripper answering from a cassette. Requests are
+// matched by method and url; repeated requests get the recorded
+// responses in order, the last one repeating.
+type Player struct {
+	mu    sync.Mutex
+	c     *Cassette
+	calls map[string]int
+}
+
+func NewPlayer(c *Cassette) *Player {
+	return &Player{c: c, calls: make(map[string]int)}
+}
+
+func (p *Player) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := req.Method + " " + req.URL.String()
+
+	p.mu.Lock()
+	n := p.calls[key]
+	p.calls[key] = n + 1
+	p.mu.Unlock()
+
+	var match *Interaction
+	seen := 0
+	for _, in := range p.c.Interactions {
+		if in.Method+" "+in.URL != key {
+			continue
+		}
+		match = in
+		if seen == n {
+			break
+		}
+		seen++
+	}
+
+	if match == nil {
+		return nil, fmt.Errorf("replay: no recorded response for %s", key)
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", match.Status, http.StatusText(match.Status)),
+		StatusCode:    match.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        match.Header.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader([]byte(match.Body))),
+		ContentLength: int64(len(match.Body)),
+		Request:       req,
+	}, nil
+}
+
+// Recorder is a RoundTripper that passes requests on to Next and records
+// the exchanges. Request headers aren't recorded, and Set-Cookie values
+// are redacted, so cassettes don't leak session cookies.
+type Recorder struct {
+	Next http.RoundTripper
+
+	mu       sync.Mutex
+	cassette Cassette
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := r.Next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	resp, err := next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	header := resp.Header.Clone()
+	if cookies := header["Set-Cookie"]; len(cookies) > 0 {
+		redacted := make([]string, len(cookies))
+		for i, c := range cookies {
+			redacted[i] = redactCookie(c)
+		}
+		header["Set-Cookie"] = redacted
+	}
+
+	r.mu.Lock()
+	r.cassette.Interactions = append(r.cassette.Interactions, &Interaction{
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Status: resp.StatusCode,
+		Header: header,
+		Body:   string(body),
+	})
+	r.mu.Unlock()
+
+	return resp, nil
+}
+
+// Cassette returns what has been recorded so far.
+func (r *Recorder) Cassette() *Cassette {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c := &Cassette{Interactions: make([]*Interaction, len(r.cassette.Interactions))}
+	copy(c.Interactions, r.cassette.Interactions)
+	return c
+}
+
+// redactCookie replaces the value in a Set-Cookie header, keeping the
+// name and attributes.
+func redactCookie(c string) string {
+	i := strings.IndexByte(c, '=')
+	if i < 0 {
+		return c
+	}
+	rest := c[i+1:]
+	if j := strings.IndexByte(rest, ';'); j >= 0 {
+		return c[:i+1] + "redacted" + rest[j:]
+	}
+	return c[:i+1] + "redacted"
+}
+
+// Case is an entry in a cases.json manifest: a post to record, and the
+// cassette name it's recorded under.
+type Case struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Offset int    `json:"offset,omitempty"`
+	// Anonymous cases are recorded without session cookies.
+	Anonymous bool `json:"anonymous,omitempty"`
+	// Synthetic cases are hand-written pages for made up posts, covering
+	// each page shape; they aren't recorded.
+	Synthetic bool `json:"synthetic,omitempty"`
+}
+
+// LoadCases reads a cases.json manifest.
+func LoadCases(path string) ([]*Case, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cases []*Case
+	if err := json.Unmarshal(data, &cases); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cases, nil
+}
@@ -0,0 +1,54 @@
+package replay
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusFound)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "sessionid", Value: "secret", Path: "/"})
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	rec := &Recorder{}
+	resp, err := (&http.Client{Transport: rec}).Get(srv.URL + "/old")
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	resp.Body.Close()
+
+	path := filepath.Join(t.TempDir(), "c.json")
+	if err := rec.Cassette().Save(path); err != nil {
+		t.Fatalf("save: %s", err)
+	}
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if len(c.Interactions) != 2 || c.Interactions[1].Header.Get("Set-Cookie") != "sessionid=redacted; Path=/" {
+		t.Fatalf("unexpected recording %#v", c.Interactions)
+	}
+
+	resp, err = (&http.Client{Transport: NewPlayer(c)}).Get(srv.URL + "/old")
+	if err != nil {
+		t.Fatalf("replay: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "hello" || resp.Request.URL.Path != "/new" {
+		t.Errorf("unexpected replay %q from %s", body, resp.Request.URL)
+	}
+
+	if _, err := NewPlayer(c).RoundTrip(httptest.NewRequest(http.MethodGet, "http://other/", nil)); err == nil {
+		t.Errorf("expected unrecorded request to fail")
+	}
+}
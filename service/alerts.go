@@ -0,0 +1,39 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+)
+
+// AdminConfig is where operational alerts go. Token needs chat:write and
+// the bot has to be in Channel.
+type AdminConfig struct {
+	Token   string `json:"token"`
+	Channel string `json:"channel"`
+}
+
+// alertAdmin posts text to the admin channel, or just logs it when no
+// admin channel is configured.
+func (h *handler) alertAdmin(ctx context.Context, text string) error {
+	log.Printf("ALERT %s", text)
+
+	admin := h.config.Admin
+	if admin == nil || admin.Token == "" || admin.Channel == "" {
+		return nil
+	}
+
+	values := url.Values{
+		"token":   {admin.Token},
+		"channel": {admin.Channel},
+		"text":    {text},
+		"mrkdwn":  {"true"},
+	}
+
+	if err := h.callSlackForm(ctx, "chat.postMessage", values, &slackAPIResponse{}); err != nil {
+		return fmt.Errorf("posting admin alert: %w", err)
+	}
+
+	return nil
+}
@@ -2,6 +2,8 @@ package service
 
 import (
 	"encoding/json"
+	"fmt"
+	"html"
 	"log"
 
 	"github.com/aws/aws-lambda-go/events"
@@ -18,6 +20,22 @@ func NewAPIResponse(code int, ctype string, data string) *events.APIGatewayProxy
 	}
 }
 
+func NewRedirectResponse(location string) *events.APIGatewayProxyResponse {
+	return &events.APIGatewayProxyResponse{
+		StatusCode: 302,
+		Headers: map[string]string{
+			"location": location,
+		},
+	}
+}
+
+func NewHTMLResponse(code int, title, message string) *events.APIGatewayProxyResponse {
+	body := fmt.Sprintf("<!doctype html><html><head><title>%s</title></head><body><h1>%s</h1><p>%s</p></body></html>",
+		html.EscapeString(title), html.EscapeString(title), html.EscapeString(message))
+
+	return NewAPIResponse(code, "text/html; charset=utf-8", body)
+}
+
 func NewSlackMessageResponse(code int, body *slack.Msg) *events.APIGatewayProxyResponse {
 	data, err := json.Marshal(body)
 	if err != nil {
@@ -0,0 +1,45 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+const auditRetention = 400 * 24 * time.Hour
+
+// AuditEntry records a change to a team's installation.
+type AuditEntry struct {
+	Time         time.Time `json:"time"`
+	Action       string    `json:"action"`
+	TeamID       string    `json:"team_id,omitempty"`
+	EnterpriseID string    `json:"enterprise_id,omitempty"`
+	EventID      string    `json:"event_id,omitempty"`
+	Detail       string    `json:"detail,omitempty"`
+}
+
+func auditStoreKey(e *AuditEntry) string {
+	return fmt.Sprintf("audit/%s/%s/%d-%s", e.EnterpriseID, e.TeamID, e.Time.UnixNano(), e.Action)
+}
+
+// recordAudit logs the entry and keeps it in the store. Audit entries are
+// not team data, so they survive purgeTeam.
+func (h *handler) recordAudit(ctx context.Context, e *AuditEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Error marshaling audit entry %#v: %s", e, err)
+		return
+	}
+
+	log.Printf("AUDIT %s", data)
+
+	if err := h.store.Put(ctx, auditStoreKey(e), data, auditRetention); err != nil {
+		log.Printf("Error storing audit entry: %s", err)
+	}
+}
@@ -2,23 +2,140 @@ package service
 
 import (
 	"encoding/json"
+	"fmt"
+	"time"
 )
 
 type Config struct {
-	QueueURL     string               `json:"queue_url"`
-	SlackTeams   map[string]*TeamInfo `json:"slack_teams"`
-	CookieString string               `json:"cookies"`
+	QueueURL   string               `json:"queue_url"`
+	SlackTeams map[string]*TeamInfo `json:"slack_teams"`
+	// CookieString is a single instagram session; prefer Sessions.
+	CookieString string        `json:"cookies"`
+	Render       *RenderConfig `json:"render,omitempty"`
+
+	// VerificationToken authenticates requests for teams installed through
+	// the oauth flow, whose tokens live in Store rather than SlackTeams.
+	VerificationToken string       `json:"verification_token,omitempty"`
+	OAuth             *OAuthConfig `json:"oauth,omitempty"`
+	Store             *StoreConfig `json:"store,omitempty"`
+
+	// DedupTTL is how long event ids are remembered to skip retries.
+	DedupTTL Duration `json:"dedup_ttl,omitempty"`
+	// SlackNoRetry sets X-Slack-No-Retry on failures that a retry won't fix.
+	SlackNoRetry bool `json:"slack_no_retry,omitempty"`
+
+	// DeadLetterQueueURL receives messages that fail permanently or more
+	// than MaxReceiveCount times.
+	DeadLetterQueueURL string `json:"dead_letter_queue_url,omitempty"`
+	MaxReceiveCount    int    `json:"max_receive_count,omitempty"`
+	// SQSWorkers is how many queue messages are processed at once.
+	SQSWorkers int `json:"sqs_workers,omitempty"`
+
+	Freshness *FreshnessConfig `json:"freshness,omitempty"`
+
+	// Jobs overrides the schedule of periodic jobs, by job name.
+	Jobs map[string]*JobConfig `json:"jobs,omitempty"`
+	// CookieCheckURL is a post fetched by the cookie_check job.
+	CookieCheckURL string `json:"cookie_check_url,omitempty"`
+	// Canary is checked by the parser_canary job.
+	Canary *CanaryConfig `json:"canary,omitempty"`
+
+	// Sessions are instagram sessions used in turn for fetches.
+	Sessions []*SessionConfig `json:"sessions,omitempty"`
+	// SessionCooldown is how long a session that hit the login wall is
+	// left out of rotation.
+	SessionCooldown    Duration `json:"session_cooldown,omitempty"`
+	MinHealthySessions int      `json:"min_healthy_sessions,omitempty"`
+
+	InstagramLimits *InstagramLimitConfig `json:"instagram_limits,omitempty"`
+	Quotas          *QuotaConfig          `json:"quotas,omitempty"`
+
+	HTTP *HTTPConfig `json:"http,omitempty"`
+	// SlackAPIURL overrides https://slack.com/api/, e.g. for a fake slack.
+	SlackAPIURL string `json:"slack_api_url,omitempty"`
+
+	// MetricsNamespace is the CloudWatch namespace for metrics; it
+	// defaults to SlackInstagram.
+	MetricsNamespace string `json:"metrics_namespace,omitempty"`
+
+	// Admin receives operational alerts.
+	Admin *AdminConfig `json:"admin,omitempty"`
+}
+
+// FreshnessConfig sets how old queued work can get, by message type,
+// before it's dropped.
+type FreshnessConfig struct {
+	Slash  Duration `json:"slash_command,omitempty"`
+	Unfurl Duration `json:"unfurl_event,omitempty"`
+}
+
+// Duration is a time.Duration read from a string like "90s" or "30m", or
+// a number of seconds.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	switch t := v.(type) {
+	case float64:
+		d.Duration = time.Duration(t * float64(time.Second))
+	case string:
+		pd, err := time.ParseDuration(t)
+		if err != nil {
+			return err
+		}
+		d.Duration = pd
+	case nil:
+		d.Duration = 0
+	default:
+		return fmt.Errorf("invalid duration %s", b)
+	}
+
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
 }
 
 type TeamInfo struct {
-	Name       string `json:"name"`
-	OauthToken string `json:"oauth_token"`
+	Name       string        `json:"name"`
+	OauthToken string        `json:"oauth_token"`
+	Render     *RenderConfig `json:"render,omitempty"`
+
+	// set for teams installed through the oauth flow
+	ID           string `json:"id,omitempty"`
+	EnterpriseID string `json:"enterprise_id,omitempty"`
+	BotUserID    string `json:"bot_user_id,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	InstalledAt  int64  `json:"installed_at,omitempty"`
+
+	// set when the app has token rotation enabled
+	RefreshToken   string `json:"refresh_token,omitempty"`
+	TokenExpiresAt int64  `json:"token_expires_at,omitempty"`
 }
 
+type OAuthConfig struct {
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url,omitempty"`
+	Scopes       []string `json:"scopes,omitempty"`
+}
+
+// NewConfigFromJSON decodes and validates a config. Secret references
+// are resolved first; see LoadConfig for layering several sources.
 func NewConfigFromJSON(j []byte) (*Config, error) {
-	cfg := &Config{}
+	cfg, err := decodeConfig(j)
+	if err != nil {
+		return nil, err
+	}
 
-	if err := json.Unmarshal(j, cfg); err != nil {
+	if err := cfg.validate(); err != nil {
 		return nil, err
 	}
 
@@ -31,3 +148,38 @@ func (c *Config) TeamByRequestToken(t string) *TeamInfo {
 	}
 	return nil
 }
+
+// validRequestToken reports whether t is a verification token we accept,
+// either for a statically configured team or for installed teams.
+func (c *Config) validRequestToken(t string) bool {
+	if t == "" {
+		return false
+	}
+	return c.TeamByRequestToken(t) != nil || t == c.VerificationToken
+}
+
+// rendererForTeam returns the team's renderer, falling back to the
+// config-wide one and then the built in defaults.
+func (c *Config) rendererForTeam(team *TeamInfo) *renderer {
+	if team != nil && team.Render != nil && team.Render.renderer != nil {
+		return team.Render.renderer
+	}
+	if c.Render != nil && c.Render.renderer != nil {
+		return c.Render.renderer
+	}
+	return defaultRenderer
+}
+
+func (rc *RenderConfig) compile() error {
+	if rc == nil {
+		return nil
+	}
+
+	r, err := newRenderer(rc)
+	if err != nil {
+		return err
+	}
+
+	rc.renderer = r
+	return nil
+}
@@ -0,0 +1,281 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ConfigEnvPrefix marks environment variables that override single config
+// keys. Nested keys are joined with a double underscore, so
+// SLACK_INSTAGRAM_OAUTH__CLIENT_SECRET sets oauth.client_secret.
+const ConfigEnvPrefix = "SLACK_INSTAGRAM_"
+
+// LoadConfig builds the config from layers, each overriding the keys it
+// sets in the ones before: the JSON file at path, if path isn't empty,
+// then CONFIG_JSON, then ConfigEnvPrefix environment variables.
+func LoadConfig(path string) (*Config, error) {
+	var layers [][]byte
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, data)
+	}
+
+	if j := os.Getenv("CONFIG_JSON"); j != "" {
+		layers = append(layers, []byte(j))
+	}
+
+	merged, err := mergeConfigLayers(layers, os.Environ())
+	if err != nil {
+		return nil, err
+	}
+
+	return NewConfigFromJSON(merged)
+}
+
+func mergeConfigLayers(layers [][]byte, environ []string) ([]byte, error) {
+	merged := map[string]interface{}{}
+
+	for i, layer := range layers {
+		var m map[string]interface{}
+		if err := json.Unmarshal(layer, &m); err != nil {
+			return nil, fmt.Errorf("config layer %d: %w", i+1, err)
+		}
+		mergeJSON(merged, m)
+	}
+
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, ConfigEnvPrefix) {
+			continue
+		}
+
+		parts := strings.SplitN(strings.TrimPrefix(kv, ConfigEnvPrefix), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			continue
+		}
+
+		path, ok := configEnvPath(reflect.TypeOf(Config{}), strings.Split(parts[0], "__"))
+		if !ok {
+			log.Printf("Ignoring %s%s, it isn't a config key", ConfigEnvPrefix, parts[0])
+			continue
+		}
+		setJSONPath(merged, path, envConfigValue(parts[1]))
+	}
+
+	return json.Marshal(merged)
+}
+
+// configEnvPath maps the segments of an override's name to the JSON keys
+// of t they name. Struct fields match their JSON name in any case; map
+// keys, like slack_teams verification tokens, are used as they are. ok is
+// false when the name isn't a config key.
+func configEnvPath(t reflect.Type, segments []string) (path []string, ok bool) {
+	unmarshaler := reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+	for _, seg := range segments {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+
+		switch {
+		case t.Kind() == reflect.Map:
+			path = append(path, seg)
+			t = t.Elem()
+		case t.Kind() == reflect.Struct && !reflect.PtrTo(t).Implements(unmarshaler):
+			f, found := jsonField(t, seg)
+			if !found {
+				return nil, false
+			}
+			path = append(path, jsonName(f))
+			t = f.Type
+		default:
+			// a value can't have keys below it
+			return nil, false
+		}
+	}
+
+	return path, len(path) > 0
+}
+
+// jsonField finds the field of struct t whose JSON name is name, ignoring
+// case.
+func jsonField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Tag.Get("json") == "-" {
+			continue
+		}
+		if strings.EqualFold(jsonName(f), name) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func jsonName(f reflect.StructField) string {
+	if name := strings.Split(f.Tag.Get("json"), ",")[0]; name != "" {
+		return name
+	}
+	return f.Name
+}
+
+// mergeJSON merges src into dst, recursing into objects both have.
+func mergeJSON(dst, src map[string]interface{}) {
+	for k, v := range src {
+		sm, ok := v.(map[string]interface{})
+		dm, dok := dst[k].(map[string]interface{})
+		if ok && dok {
+			mergeJSON(dm, sm)
+			continue
+		}
+		dst[k] = v
+	}
+}
+
+func setJSONPath(m map[string]interface{}, path []string, v interface{}) {
+	for _, k := range path[:len(path)-1] {
+		next, ok := m[k].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			m[k] = next
+		}
+		m = next
+	}
+	m[path[len(path)-1]] = v
+}
+
+// envConfigValue reads an override as JSON when it is JSON, so objects,
+// numbers and booleans can be set, and as a plain string otherwise. Quote
+// strings that would parse as something else, e.g. '"123"'.
+func envConfigValue(s string) interface{} {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err == nil {
+		return v
+	}
+	return s
+}
+
+// resolveSecrets replaces secret references anywhere in v, objects with a
+// single "$env" or "$file" key, with the environment variable or file
+// contents they name. Trailing newlines are dropped from files.
+func resolveSecrets(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if len(t) == 1 {
+			if name, ok := t["$env"].(string); ok {
+				s, ok := os.LookupEnv(name)
+				if !ok {
+					return nil, fmt.Errorf("secret $env %s is not set", name)
+				}
+				return s, nil
+			}
+			if path, ok := t["$file"].(string); ok {
+				data, err := ioutil.ReadFile(path)
+				if err != nil {
+					return nil, fmt.Errorf("secret $file: %w", err)
+				}
+				return strings.TrimRight(string(data), "\r\n"), nil
+			}
+		}
+
+		for k, e := range t {
+			r, err := resolveSecrets(e)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			t[k] = r
+		}
+		return t, nil
+
+	case []interface{}:
+		for i, e := range t {
+			r, err := resolveSecrets(e)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+			t[i] = r
+		}
+		return t, nil
+	}
+
+	return v, nil
+}
+
+// decodeConfig resolves secret references in j and decodes it. Unknown
+// keys are logged rather than rejected, so configs carrying legacy keys
+// keep loading while typos still show up.
+func decodeConfig(j []byte) (*Config, error) {
+	var raw interface{}
+	if err := json.Unmarshal(j, &raw); err != nil {
+		return nil, err
+	}
+
+	resolved, err := resolveSecrets(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(resolved)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range unknownConfigKeys(reflect.TypeOf(Config{}), resolved, "") {
+		log.Printf("Ignoring unknown config key %s", key)
+	}
+
+	cfg := &Config{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// unknownConfigKeys lists the keys in v, decoded JSON, that have no field
+// in t, as dotted paths from prefix.
+func unknownConfigKeys(t reflect.Type, v interface{}, prefix string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+		return nil
+	}
+
+	var unknown []string
+	switch t.Kind() {
+	case reflect.Struct:
+		m, _ := v.(map[string]interface{})
+		for k, sub := range m {
+			f, ok := jsonField(t, k)
+			if !ok {
+				unknown = append(unknown, prefix+k)
+				continue
+			}
+			unknown = append(unknown, unknownConfigKeys(f.Type, sub, prefix+k+".")...)
+		}
+	case reflect.Map:
+		m, _ := v.(map[string]interface{})
+		for k, sub := range m {
+			unknown = append(unknown, unknownConfigKeys(t.Elem(), sub, prefix+k+".")...)
+		}
+	case reflect.Slice, reflect.Array:
+		l, _ := v.([]interface{})
+		for i, sub := range l {
+			unknown = append(unknown, unknownConfigKeys(t.Elem(), sub, fmt.Sprintf("%s%d.", prefix, i))...)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
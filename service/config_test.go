@@ -0,0 +1,159 @@
+package service
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConfigLayers(t *testing.T) {
+	dir := t.TempDir()
+	secretPath := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(secretPath, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("TEST_CLIENT_ID", "from-env")
+	defer os.Unsetenv("TEST_CLIENT_ID")
+
+	file := []byte(`{
+		"queue_url": "https://sqs/file",
+		"verification_token": "vt",
+		"dedup_ttl": "1h",
+		"oauth": {"client_id": {"$env": "TEST_CLIENT_ID"}, "client_secret": "file-secret"},
+		"sessions": [{"name": "a", "cookies": "sessionid=a"}],
+		"store": {"type": "file", "path": "store.json"}
+	}`)
+	configJSON := []byte(`{"queue_url": "https://sqs/config-json", "oauth": {"client_secret": {"$file": "` + secretPath + `"}}}`)
+	environ := []string{
+		"SLACK_INSTAGRAM_DEDUP_TTL=90",
+		"SLACK_INSTAGRAM_OAUTH__REDIRECT_URL=https://example.com/slack/oauth",
+		"SLACK_INSTAGRAM_QUOTAS={\"team_per_day\": 100}",
+		"SLACK_INSTAGRAM_SLACK_TEAMS__TeamTkn__OAUTH_TOKEN=xoxb-env",
+		"SLACK_INSTAGRAM_LOG_LEVEL=debug",
+		"SLACK_INSTAGRAM_OAUTH__CLIENT_SECRET__X=1",
+		"OTHER=1",
+	}
+
+	merged, err := mergeConfigLayers([][]byte{file, configJSON}, environ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := NewConfigFromJSON(merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.QueueURL != "https://sqs/config-json" {
+		t.Errorf("CONFIG_JSON should override the file, got queue_url %s", cfg.QueueURL)
+	}
+	want := &OAuthConfig{ClientID: "from-env", ClientSecret: "from-file", RedirectURL: "https://example.com/slack/oauth"}
+	if !reflect.DeepEqual(cfg.OAuth, want) {
+		t.Errorf("expected oauth %+v, got %+v", want, cfg.OAuth)
+	}
+	if cfg.DedupTTL.Duration != 90*time.Second || cfg.Quotas == nil || cfg.Quotas.TeamPerDay != 100 {
+		t.Errorf("env overrides not applied: %v %+v", cfg.DedupTTL, cfg.Quotas)
+	}
+	if team := cfg.SlackTeams["TeamTkn"]; team == nil || team.OauthToken != "xoxb-env" {
+		t.Errorf("expected the team's verification token to keep its case, got %+v", cfg.SlackTeams)
+	}
+	if len(cfg.Sessions) != 1 || cfg.VerificationToken != "vt" {
+		t.Errorf("file settings lost")
+	}
+
+	if _, err := NewConfigFromJSON([]byte(`{"queue_url": "q", "oauth": {"client_id": {"$env": "TEST_MISSING"}}}`)); err == nil {
+		t.Errorf("expected a missing secret to fail")
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		json     string
+		problems []string
+	}{
+		{
+			name:     "empty",
+			json:     `{}`,
+			problems: []string{"queue_url is required", "slack_teams or oauth is required, or no team can use the bot"},
+		},
+		{
+			name: "minimal",
+			json: `{"queue_url": "q", "slack_teams": {"tkn": {"name": "t", "oauth_token": "xoxb"}}}`,
+		},
+		{
+			name: "everything wrong",
+			json: `{
+				"queue_url": "q",
+				"dead_letter_queue_url": "q",
+				"slack_teams": {"tkn": {"name": "t", "render": {"fields": ["nope"]}}},
+				"oauth": {"client_id": "c", "redirect_url": "/relative"},
+				"store": {"type": "file"},
+				"sqs_workers": -1,
+				"sessions": [{"name": "a", "cookies": "x"}, {"name": "a"}],
+				"jobs": {"nightly": {"every": "1h"}},
+				"cookie_check_url": "https://example.com/",
+				"admin": {"token": "xoxb"},
+				"quotas": {"user_per_minute": -5}
+			}`,
+			problems: []string{
+				"slack_teams: team t needs an oauth_token",
+				`slack_teams: render for team t: unknown render field "nope"`,
+				"oauth needs client_id and client_secret",
+				"oauth needs verification_token to accept requests from installed teams",
+				"oauth.redirect_url should be an absolute http(s) url",
+				"store: file store needs a path",
+				"sqs_workers can't be negative",
+				"quotas.user_per_minute can't be negative",
+				"sessions: a is listed twice",
+				"sessions: a has no cookies",
+				`jobs: unknown job "nightly"`,
+				"cookie_check_url should be an instagram post url",
+				"admin needs a token and channel",
+				"dead_letter_queue_url can't be the queue itself",
+			},
+		},
+		{
+			name: "null entries",
+			json: `{
+				"queue_url": "q",
+				"slack_teams": {"tkn": null},
+				"sessions": [null],
+				"canary": {"posts": [null]}
+			}`,
+			problems: []string{
+				"slack_teams: a team is null",
+				"sessions[0] is null",
+				"canary.posts[0] is null",
+			},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := NewConfigFromJSON([]byte(c.json))
+
+			var problems []string
+			var ce *ConfigError
+			if errors.As(err, &ce) {
+				problems = ce.Problems
+			} else if err != nil {
+				t.Fatalf("unexpected error %s", err)
+			}
+
+			if !reflect.DeepEqual(problems, c.problems) {
+				t.Errorf("expected problems\n%q\ngot\n%q", c.problems, problems)
+			}
+		})
+	}
+
+	unknown := unknownConfigKeys(reflect.TypeOf(Config{}), map[string]interface{}{
+		"queue_url":  "q",
+		"slack_team": map[string]interface{}{},
+		"http":       map[string]interface{}{"user_agent": "a", "proxies": []interface{}{}},
+	}, "")
+	if !reflect.DeepEqual(unknown, []string{"http.proxies", "slack_team"}) {
+		t.Errorf("unexpected unknown keys %q", unknown)
+	}
+}
@@ -0,0 +1,239 @@
+package service
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ConfigError lists everything wrong with a config, so it can all be
+// fixed in one go.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid config: " + strings.Join(e.Problems, "; ")
+}
+
+type configProblems []string
+
+func (p *configProblems) add(format string, args ...interface{}) {
+	*p = append(*p, fmt.Sprintf(format, args...))
+}
+
+// validate checks the config for anything that would otherwise only fail
+// at runtime, and compiles render templates.
+func (c *Config) validate() error {
+	var p configProblems
+
+	if c.QueueURL == "" {
+		p.add("queue_url is required")
+	}
+
+	if len(c.SlackTeams) == 0 && c.OAuth == nil {
+		p.add("slack_teams or oauth is required, or no team can use the bot")
+	}
+
+	for _, token := range sortedTeamTokens(c.SlackTeams) {
+		team := c.SlackTeams[token]
+		if team == nil {
+			// don't put the token in logs
+			p.add("slack_teams: a team is null")
+			continue
+		}
+		name := team.Name
+		if name == "" {
+			name = "(unnamed)"
+		}
+
+		if token == "" {
+			p.add("slack_teams: team %s has an empty verification token", name)
+		}
+		if team.OauthToken == "" {
+			p.add("slack_teams: team %s needs an oauth_token", name)
+		}
+		if err := team.Render.compile(); err != nil {
+			p.add("slack_teams: render for team %s: %s", name, err)
+		}
+	}
+
+	if o := c.OAuth; o != nil {
+		if o.ClientID == "" || o.ClientSecret == "" {
+			p.add("oauth needs client_id and client_secret")
+		}
+		if c.VerificationToken == "" {
+			p.add("oauth needs verification_token to accept requests from installed teams")
+		}
+		if o.RedirectURL != "" {
+			checkURL(&p, "oauth.redirect_url", o.RedirectURL)
+		}
+	}
+
+	if c.OAuth != nil && (c.Store == nil || c.Store.Type == "" || c.Store.Type == StoreTypeMemory) {
+		p.add("oauth needs a persistent store, or installs are lost on restart")
+	}
+
+	if s := c.Store; s != nil {
+		switch s.Type {
+		case "", StoreTypeMemory:
+		case StoreTypeFile:
+			if s.Path == "" {
+				p.add("store: file store needs a path")
+			}
+		case StoreTypeDynamoDB:
+			if s.Table == "" {
+				p.add("store: dynamodb store needs a table")
+			}
+		default:
+			p.add("store: unknown type %q", s.Type)
+		}
+	}
+
+	limits := []namedValue{
+		{"dedup_ttl", c.DedupTTL.Duration},
+		{"session_cooldown", c.SessionCooldown.Duration},
+		{"max_receive_count", c.MaxReceiveCount},
+		{"sqs_workers", c.SQSWorkers},
+		{"min_healthy_sessions", c.MinHealthySessions},
+	}
+	if f := c.Freshness; f != nil {
+		limits = append(limits,
+			namedValue{"freshness.slash_command", f.Slash.Duration},
+			namedValue{"freshness.unfurl_event", f.Unfurl.Duration})
+	}
+	if l := c.InstagramLimits; l != nil {
+		limits = append(limits,
+			namedValue{"instagram_limits.per_minute", l.PerMinute},
+			namedValue{"instagram_limits.burst", l.Burst},
+			namedValue{"instagram_limits.session_per_minute", l.SessionPerMinute},
+			namedValue{"instagram_limits.session_burst", l.SessionBurst},
+			namedValue{"instagram_limits.breaker_threshold", l.BreakerThreshold},
+			namedValue{"instagram_limits.breaker_cooldown", l.BreakerCooldown.Duration})
+	}
+	if q := c.Quotas; q != nil {
+		limits = append(limits,
+			namedValue{"quotas.user_per_minute", q.UserPerMinute},
+			namedValue{"quotas.team_per_day", q.TeamPerDay})
+	}
+	for _, v := range limits {
+		if v.negative() {
+			p.add("%s can't be negative", v.name)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i, s := range c.Sessions {
+		if s == nil {
+			p.add("sessions[%d] is null", i)
+			continue
+		}
+		if s.Name == "" {
+			p.add("sessions[%d] needs a name", i)
+		} else if seen[s.Name] {
+			p.add("sessions: %s is listed twice", s.Name)
+		}
+		seen[s.Name] = true
+
+		if s.Cookies == "" {
+			p.add("sessions: %s has no cookies", s.Name)
+		}
+	}
+
+	for _, name := range sortedJobNames(c.Jobs) {
+		jc := c.Jobs[name]
+		if _, ok := jobs[name]; !ok {
+			p.add("jobs: unknown job %q", name)
+		}
+		if jc != nil && jc.Every.Duration < 0 {
+			p.add("jobs: %s every can't be negative", name)
+		}
+	}
+
+	if c.CookieCheckURL != "" && !isInstagramPostURL(c.CookieCheckURL) {
+		p.add("cookie_check_url should be an instagram post url")
+	}
+	if c.Canary != nil {
+		for i, post := range c.Canary.Posts {
+			if post == nil {
+				p.add("canary.posts[%d] is null", i)
+			} else if !isInstagramPostURL(post.URL) {
+				p.add("canary.posts[%d] should be an instagram post url", i)
+			}
+		}
+	}
+
+	if a := c.Admin; a != nil && (a.Token == "" || a.Channel == "") {
+		p.add("admin needs a token and channel")
+	}
+
+	if c.SlackAPIURL != "" {
+		checkURL(&p, "slack_api_url", c.SlackAPIURL)
+	}
+	if c.DeadLetterQueueURL != "" && c.DeadLetterQueueURL == c.QueueURL {
+		p.add("dead_letter_queue_url can't be the queue itself")
+	}
+
+	if err := c.Render.compile(); err != nil {
+		p.add("render: %s", err)
+	}
+	if _, err := newHTTPClients(c.HTTP, nil); err != nil {
+		p.add("http: %s", err)
+	}
+
+	if len(p) > 0 {
+		return &ConfigError{Problems: p}
+	}
+	return nil
+}
+
+// namedValue is a setting that can't be negative; value is an int,
+// float64 or time.Duration.
+type namedValue struct {
+	name  string
+	value interface{}
+}
+
+func (v namedValue) negative() bool {
+	switch n := v.value.(type) {
+	case int:
+		return n < 0
+	case float64:
+		return n < 0
+	case time.Duration:
+		return n < 0
+	}
+	return false
+}
+
+func checkURL(p *configProblems, name, s string) {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		p.add("%s should be an absolute http(s) url", name)
+	}
+}
+
+func isInstagramPostURL(s string) bool {
+	return strings.HasPrefix(s, "https://www.instagram.com/")
+}
+
+// sortedTeamTokens and sortedJobNames keep problems in a stable order.
+func sortedTeamTokens(teams map[string]*TeamInfo) []string {
+	tokens := make([]string, 0, len(teams))
+	for t := range teams {
+		tokens = append(tokens, t)
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
+func sortedJobNames(m map[string]*JobConfig) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
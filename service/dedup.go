@@ -0,0 +1,58 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"time"
+)
+
+const defaultDedupTTL = time.Hour
+
+func dedupStoreKey(kind, id string) string {
+	return "dedup/" + kind + "/" + id
+}
+
+// dedupID shortens an arbitrary identifier, such as a response_url, into
+// something suitable for a store key.
+func dedupID(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:16])
+}
+
+func (h *handler) dedupTTL() time.Duration {
+	if h.config.DedupTTL.Duration > 0 {
+		return h.config.DedupTTL.Duration
+	}
+	return defaultDedupTTL
+}
+
+// claimOnce reports whether this is the first time the id has been seen
+// within the dedup ttl. Store errors let the request through, since
+// duplicate work is better than dropped work.
+func (h *handler) claimOnce(ctx context.Context, kind, id string) bool {
+	if id == "" {
+		return true
+	}
+
+	n, err := h.store.Add(ctx, dedupStoreKey(kind, id), 1, h.dedupTTL())
+	if err != nil {
+		log.Printf("Error checking for duplicate %s %s: %s", kind, id, err)
+		return true
+	}
+
+	return n == 1
+}
+
+// releaseClaim forgets a claim so that a retry of a request we failed to
+// handle is processed.
+func (h *handler) releaseClaim(ctx context.Context, kind, id string) {
+	if id == "" {
+		return
+	}
+
+	if err := h.store.Delete(ctx, dedupStoreKey(kind, id)); err != nil {
+		log.Printf("Error releasing %s %s: %s", kind, id, err)
+	}
+}
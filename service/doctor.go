@@ -0,0 +1,162 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Check is the outcome of one Doctor check. Err is nil when it passed;
+// Skipped is set when there was nothing to check.
+type Check struct {
+	Name    string
+	Detail  string
+	Err     error
+	Skipped bool
+}
+
+// Doctor checks that what the handler depends on works: the slack tokens
+// of statically configured teams and the admin, the queues, the store,
+// the instagram sessions, and the last run of each job. Installed teams aren't checked; their
+// tokens are refreshed as they're used. Checks only read, so it's safe
+// to run against a live deployment's store.
+func Doctor(ctx context.Context, lh lambda.Handler) []*Check {
+	h, ok := lh.(*handler)
+	if !ok {
+		return []*Check{{Name: "handler", Err: fmt.Errorf("doctor needs a handler from NewHandler, got %T", lh)}}
+	}
+
+	var checks []*Check
+
+	for _, token := range sortedTeamTokens(h.config.SlackTeams) {
+		team := h.config.SlackTeams[token]
+		checks = append(checks, h.checkSlackToken(ctx, "slack token for team "+team.Name, team.OauthToken))
+	}
+	if a := h.config.Admin; a != nil {
+		checks = append(checks, h.checkSlackToken(ctx, "slack token for admin alerts", a.Token))
+	}
+
+	checks = append(checks, h.checkQueue(ctx, "queue", h.config.QueueURL))
+	if h.config.DeadLetterQueueURL != "" {
+		checks = append(checks, h.checkQueue(ctx, "dead letter queue", h.config.DeadLetterQueueURL))
+	}
+
+	checks = append(checks, h.checkStore(ctx))
+	checks = append(checks, h.checkSessions(ctx)...)
+	checks = append(checks, h.checkJobs(ctx)...)
+
+	return checks
+}
+
+func (h *handler) checkSlackToken(ctx context.Context, name, token string) *Check {
+	c := &Check{Name: name}
+
+	resp := &authTestResponse{}
+	if c.Err = h.callSlackForm(ctx, "auth.test", url.Values{"token": {token}}, resp); c.Err == nil {
+		c.Detail = fmt.Sprintf("%s (%s) as %s", resp.Team, resp.TeamID, resp.User)
+	}
+
+	return c
+}
+
+func (h *handler) checkQueue(ctx context.Context, name, queueURL string) *Check {
+	c := &Check{Name: name}
+
+	out, err := h.queue.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(queueURL),
+		AttributeNames: aws.StringSlice([]string{sqs.QueueAttributeNameApproximateNumberOfMessages}),
+	})
+	if err != nil {
+		c.Err = err
+		return c
+	}
+
+	c.Detail = fmt.Sprintf("%s messages waiting", aws.StringValue(out.Attributes[sqs.QueueAttributeNameApproximateNumberOfMessages]))
+	return c
+}
+
+// checkStore reads the instagram breaker, which is usually missing; any
+// answer means the store is reachable.
+func (h *handler) checkStore(ctx context.Context) *Check {
+	c := &Check{Name: "store"}
+
+	if _, err := h.store.Get(ctx, instaBreakerKey); err != nil && err != errNotFound {
+		c.Err = err
+	}
+
+	return c
+}
+
+// checkSessions fetches the cookie check post, or the first canary post,
+// with each session, without marking sessions or counting failures
+// towards the breaker.
+func (h *handler) checkSessions(ctx context.Context) []*Check {
+	checkURL := h.config.CookieCheckURL
+	if checkURL == "" && h.config.Canary != nil && len(h.config.Canary.Posts) > 0 {
+		checkURL = h.config.Canary.Posts[0].URL
+	}
+	if checkURL == "" {
+		return []*Check{{Name: "instagram sessions", Detail: "set cookie_check_url to check them", Skipped: true}}
+	}
+
+	var checks []*Check
+	for _, sc := range h.config.sessions() {
+		c := &Check{Name: "instagram session " + sc.Name}
+		if sc.Cookies == "" {
+			c.Err = fmt.Errorf("no cookies")
+		} else if c.Err = h.checkSessionQuietly(ctx, h.loadSession(ctx, sc), checkURL); c.Err == nil {
+			c.Detail = "fetched " + checkURL
+		}
+		checks = append(checks, c)
+	}
+
+	return checks
+}
+
+func (h *handler) checkSessionQuietly(ctx context.Context, s *session, checkURL string) error {
+	page, err := h.peekInstaPageWith(ctx, checkURL, s)
+	if err != nil {
+		return err
+	}
+	return checkSessionPage(page, checkURL)
+}
+
+// checkJobs reports each job's last run from its stored status, failing
+// jobs whose last run failed.
+func (h *handler) checkJobs(ctx context.Context) []*Check {
+	var checks []*Check
+	for _, name := range jobNames() {
+		c := &Check{Name: "job " + name}
+		checks = append(checks, c)
+
+		if h.jobInterval(jobs[name]) <= 0 {
+			c.Detail, c.Skipped = "disabled", true
+			continue
+		}
+
+		status, err := h.jobStatus(ctx, name)
+		if err != nil {
+			c.Err = err
+			continue
+		}
+		if status.Runs == 0 {
+			c.Detail = "not run yet"
+			continue
+		}
+
+		c.Detail = fmt.Sprintf("last ran %s, %d runs", status.LastStart.Format(time.RFC3339), status.Runs)
+		if !status.LastSuccess.IsZero() {
+			c.Detail += ", last succeeded " + status.LastSuccess.Format(time.RFC3339)
+		}
+		if status.Failures > 0 {
+			c.Err = fmt.Errorf("%d failed runs in a row, last: %s", status.Failures, status.LastError)
+		}
+	}
+
+	return checks
+}
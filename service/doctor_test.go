@@ -0,0 +1,70 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDoctor(t *testing.T) {
+	e := newE2E(t, "synthetic_single")
+	e.h.config.CookieCheckURL = "https://www.instagram.com/p/B_single01/"
+	e.h.config.Admin = &AdminConfig{Token: "xoxb-admin", Channel: "C1"}
+	e.slack.FailWith("auth.test", "invalid_auth", 1)
+	failed := &JobStatus{Name: "cookie_check", LastStart: time.Now(), Runs: 3, Failures: 2, LastError: "boom"}
+	if err := e.h.putJobStatus(context.Background(), failed); err != nil {
+		t.Fatalf("put status: %s", err)
+	}
+	e.h.store = &readOnlyStore{t: t, Store: e.h.store}
+
+	got := map[string]*Check{}
+	for _, c := range Doctor(context.Background(), e.h) {
+		got[c.Name] = c
+	}
+
+	for name, ok := range map[string]bool{
+		"slack token for team static":  false,
+		"slack token for admin alerts": true,
+		"queue":                        true,
+		"store":                        true,
+		"instagram session default":    true,
+		"job cookie_check":             false,
+		"job parser_canary":            true,
+	} {
+		c := got[name]
+		if c == nil {
+			t.Errorf("missing check %s", name)
+		} else if (c.Err == nil) != ok {
+			t.Errorf("check %s: expected ok %v, got %v", name, ok, c.Err)
+		}
+	}
+
+	if c := got["job parser_canary"]; c != nil && !c.Skipped {
+		t.Errorf("expected the disabled canary job to be skipped")
+	}
+
+	if n := len(e.slack.Calls("auth.test")); n != 2 {
+		t.Errorf("expected two auth.test calls, got %d", n)
+	}
+}
+
+// readOnlyStore fails the test on any write.
+type readOnlyStore struct {
+	t *testing.T
+	Store
+}
+
+func (s *readOnlyStore) Put(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	s.t.Errorf("unexpected write to %s", key)
+	return nil
+}
+
+func (s *readOnlyStore) Delete(ctx context.Context, key string) error {
+	s.t.Errorf("unexpected delete of %s", key)
+	return nil
+}
+
+func (s *readOnlyStore) Add(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	s.t.Errorf("unexpected update of %s", key)
+	return 0, nil
+}
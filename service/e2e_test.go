@@ -0,0 +1,274 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/slack-go/slack"
+
+	"github.com/yemble/slack-instagram/replay"
+	"github.com/yemble/slack-instagram/slacktest"
+)
+
+const (
+	e2eQueueURL = "local-queue"
+	e2eDLQURL   = "local-dlq"
+)
+
+// e2e wires a handler to a fake slack, a local queue and instagram
+// fixture cassettes.
+type e2e struct {
+	t     *testing.T
+	h     *handler
+	slack *slacktest.Server
+	queue *MemoryQueue
+}
+
+func newE2E(t *testing.T, fixtures ...string) *e2e {
+	cassette := &replay.Cassette{}
+	for _, name := range fixtures {
+		c, err := replay.Load(filepath.Join("testdata", "fixtures", name+".json"))
+		if err != nil {
+			t.Fatalf("loading fixture: %s", err)
+		}
+		cassette.Interactions = append(cassette.Interactions, c.Interactions...)
+	}
+
+	fake := slacktest.NewServer()
+	t.Cleanup(fake.Close)
+
+	fakeURL, _ := url.Parse(fake.URL)
+	player := replay.NewPlayer(cassette)
+	rt := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host == fakeURL.Host {
+			return fake.Client().Transport.RoundTrip(req)
+		}
+		return player.RoundTrip(req)
+	})
+
+	cfg := &Config{
+		QueueURL:           e2eQueueURL,
+		DeadLetterQueueURL: e2eDLQURL,
+		CookieString:       "sessionid=test",
+		VerificationToken:  "vtkn",
+		SlackTeams: map[string]*TeamInfo{
+			"static-token": {Name: "static", OauthToken: "xoxb-static"},
+		},
+		OAuth:       &OAuthConfig{ClientID: "cid", ClientSecret: "secret"},
+		SlackAPIURL: fake.APIURL(),
+	}
+
+	queue := NewMemoryQueue()
+
+	return &e2e{
+		t:     t,
+		h:     NewHandler(cfg, queue, newMemoryStore(), WithTransport(rt)).(*handler),
+		slack: fake,
+		queue: queue,
+	}
+}
+
+func (e *e2e) invoke(payload interface{}) map[string]interface{} {
+	e.t.Helper()
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		e.t.Fatalf("marshal: %s", err)
+	}
+
+	out, err := e.h.Invoke(context.Background(), data)
+	if err != nil {
+		e.t.Fatalf("invoke: %s", err)
+	}
+
+	resp := map[string]interface{}{}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		e.t.Fatalf("unmarshal response %s: %s", out, err)
+	}
+	return resp
+}
+
+func (e *e2e) post(contentType, body string) map[string]interface{} {
+	return e.invoke(map[string]interface{}{
+		"httpMethod": "POST",
+		"path":       "/slack",
+		"headers":    map[string]string{"Content-Type": contentType},
+		"body":       body,
+	})
+}
+
+func (e *e2e) get(path string, query map[string]string) map[string]interface{} {
+	return e.invoke(map[string]interface{}{
+		"version":               "2.0",
+		"rawPath":               path,
+		"queryStringParameters": query,
+		"requestContext": map[string]interface{}{
+			"domainName": "abc.lambda-url.us-east-1.on.aws",
+			"http":       map[string]string{"method": "GET", "path": path},
+		},
+	})
+}
+
+func (e *e2e) deliver() (delivered, failed int) {
+	e.t.Helper()
+
+	delivered, failed, err := e.queue.Deliver(context.Background(), e.h, e2eQueueURL)
+	if err != nil {
+		e.t.Fatalf("deliver: %s", err)
+	}
+	return delivered, failed
+}
+
+func (e *e2e) slashCommand(text, responseID string) map[string]interface{} {
+	return e.post("application/x-www-form-urlencoded", url.Values{
+		"token":        {"static-token"},
+		"team_id":      {"T1"},
+		"channel_id":   {"C1"},
+		"user_id":      {"U1"},
+		"command":      {slashCommand},
+		"text":         {text},
+		"trigger_id":   {"trigger-" + responseID},
+		"response_url": {e.slack.ResponseURL(responseID)},
+	}.Encode())
+}
+
+func TestE2ESlashCommand(t *testing.T) {
+	e := newE2E(t, "synthetic_carousel")
+
+	resp := e.slashCommand("https://www.instagram.com/p/CA1lPepDJXO/ 2", "r1")
+	if resp["statusCode"] != float64(200) || !strings.Contains(resp["body"].(string), "Fetching") {
+		t.Fatalf("unexpected slash response %v", resp)
+	}
+
+	if delivered, failed := e.deliver(); delivered != 1 || failed != 0 {
+		t.Fatalf("expected one message to be handled, got %d delivered %d failed", delivered, failed)
+	}
+
+	posts := e.slack.Calls("response_url")
+	if len(posts) != 1 || posts[0].Path != "/response/r1" {
+		t.Fatalf("expected one response_url post, got %d", len(posts))
+	}
+
+	msg := &slack.Msg{}
+	if err := posts[0].JSON(msg); err != nil {
+		t.Fatalf("decoding response: %s", err)
+	}
+	if msg.ResponseType != slack.ResponseTypeInChannel || !strings.Contains(msg.Text, "by @harbour.photos") || len(msg.Blocks.BlockSet) == 0 {
+		t.Errorf("unexpected slash response message %#v", msg)
+	}
+}
+
+func TestE2ESlashCommandFailure(t *testing.T) {
+	e := newE2E(t, "synthetic_not_found")
+
+	e.slashCommand("https://www.instagram.com/p/B_missing1/", "r2")
+	if _, failed := e.deliver(); failed != 0 {
+		t.Fatalf("expected permanent failure not to be retried")
+	}
+	if n := e.queue.Len(e2eDLQURL); n != 1 {
+		t.Errorf("expected the message to be dead lettered, got %d", n)
+	}
+
+	posts := e.slack.Calls("response_url")
+	if len(posts) != 1 {
+		t.Fatalf("expected the user to be told, got %d posts", len(posts))
+	}
+	msg := &slack.Msg{}
+	posts[0].JSON(msg)
+	if msg.ResponseType != slack.ResponseTypeEphemeral || msg.Text != "Error fetching data from instagram" {
+		t.Errorf("unexpected failure message %#v", msg)
+	}
+}
+
+func TestE2EUnfurl(t *testing.T) {
+	e := newE2E(t, "synthetic_single")
+
+	event := map[string]interface{}{
+		"token":    "static-token",
+		"team_id":  "T1",
+		"type":     "event_callback",
+		"event_id": "Ev1",
+		"event": map[string]interface{}{
+			"type":       "link_shared",
+			"channel":    "C1",
+			"user":       "U1",
+			"message_ts": "1.2",
+			"links":      []map[string]string{{"domain": "instagram.com", "url": "https://www.instagram.com/p/B_single01/"}},
+		},
+	}
+	body, _ := json.Marshal(event)
+
+	if resp := e.post("application/json", string(body)); resp["statusCode"] != float64(200) {
+		t.Fatalf("unexpected event response %v", resp)
+	}
+
+	// slack rate limits the first attempt
+	e.slack.FailWith("chat.unfurl", "ratelimited", 1)
+
+	if delivered, failed := e.deliver(); delivered != 1 || failed != 1 {
+		t.Fatalf("expected the first attempt to fail, got %d delivered %d failed", delivered, failed)
+	}
+	if delivered, failed := e.deliver(); delivered != 1 || failed != 0 {
+		t.Fatalf("expected the retry to succeed, got %d delivered %d failed", delivered, failed)
+	}
+
+	calls := e.slack.Calls("chat.unfurl")
+	if len(calls) != 2 {
+		t.Fatalf("expected two chat.unfurl calls, got %d", len(calls))
+	}
+
+	unfurl := &struct {
+		Channel string                            `json:"channel"`
+		TS      string                            `json:"ts"`
+		Unfurls map[string]map[string]interface{} `json:"unfurls"`
+	}{}
+	if err := calls[1].JSON(unfurl); err != nil {
+		t.Fatalf("decoding unfurl: %s", err)
+	}
+	if calls[1].Token() != "xoxb-static" || unfurl.Channel != "C1" || unfurl.TS != "1.2" || unfurl.Unfurls["https://www.instagram.com/p/B_single01/"] == nil {
+		t.Errorf("unexpected unfurl %#v with token %s", unfurl, calls[1].Token())
+	}
+
+	// slack's retry of the event is skipped
+	if resp := e.post("application/json", string(body)); resp["body"] != "Duplicate event" || e.queue.Len(e2eQueueURL) != 0 {
+		t.Errorf("expected duplicate event to be skipped, got %v", resp)
+	}
+}
+
+func TestE2EOAuthInstall(t *testing.T) {
+	e := newE2E(t)
+
+	resp := e.get(installPath, nil)
+	location, _ := resp["headers"].(map[string]interface{})["location"].(string)
+	u, err := url.Parse(location)
+	if resp["statusCode"] != float64(302) || err != nil || u.Query().Get("state") == "" {
+		t.Fatalf("unexpected install response %v", resp)
+	}
+
+	resp = e.get(oauthCallbackPath, map[string]string{"code": "c1", "state": u.Query().Get("state")})
+	if resp["statusCode"] != float64(200) {
+		t.Fatalf("unexpected callback response %v", resp)
+	}
+
+	calls := e.slack.Calls("oauth.v2.access")
+	if len(calls) != 1 || calls[0].Form.Get("code") != "c1" || calls[0].Form.Get("client_secret") != "secret" {
+		t.Fatalf("unexpected oauth calls %#v", calls)
+	}
+
+	team := e.h.teamForRequest(context.Background(), "vtkn", teamKey{TeamID: "T1"})
+	if team == nil || team.OauthToken != "xoxb-test" {
+		t.Errorf("expected installed team, got %#v", team)
+	}
+
+	e.slack.FailWith("oauth.v2.access", "invalid_code", 1)
+	resp = e.get(installPath, nil)
+	u, _ = url.Parse(resp["headers"].(map[string]interface{})["location"].(string))
+	if resp = e.get(oauthCallbackPath, map[string]string{"code": "bad", "state": u.Query().Get("state")}); resp["statusCode"] != float64(502) {
+		t.Errorf("expected failed exchange to be reported, got %v", resp)
+	}
+}
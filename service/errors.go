@@ -0,0 +1,55 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// permanentError marks a failure that retrying won't fix, so the queued
+// message is given up on straight away.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+func isPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+// httpStatusError is an unexpected http status from a service.
+type httpStatusError struct {
+	what string
+	code int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("%s: unexpected status %d", e.what, e.code)
+}
+
+// statusError describes an unexpected http status; client errors other
+// than timeouts and rate limiting are permanent.
+func statusError(what string, code int) error {
+	err := &httpStatusError{what: what, code: code}
+
+	if code >= 400 && code < 500 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests {
+		return permanent(err)
+	}
+
+	return err
+}
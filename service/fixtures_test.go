@@ -0,0 +1,44 @@
+package service
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/yemble/slack-instagram/replay"
+)
+
+type fixtureResult struct {
+	Meta      *InstaMeta `json:"meta,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Permanent bool       `json:"permanent,omitempty"`
+}
+
+func TestFixtures(t *testing.T) {
+	cases, err := replay.LoadCases(filepath.Join("testdata", "fixtures", "cases.json"))
+	if err != nil {
+		t.Fatalf("loading cases: %s", err)
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			cassette, err := replay.Load(filepath.Join("testdata", "fixtures", c.Name+".json"))
+			if err != nil {
+				t.Fatalf("loading fixture: %s", err)
+			}
+
+			h := NewHandler(&Config{CookieString: "sessionid=test"}, nil, newMemoryStore(), WithTransport(replay.NewPlayer(cassette))).(*handler)
+
+			res := &fixtureResult{}
+			meta, err := h.fetchInsta(context.Background(), c.URL, c.Offset)
+			if err != nil {
+				res.Error = err.Error()
+				res.Permanent = isPermanent(err)
+			} else {
+				res.Meta = meta
+			}
+
+			checkGolden(t, "fixture_"+c.Name, res)
+		})
+	}
+}
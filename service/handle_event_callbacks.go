@@ -4,20 +4,53 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/slack-go/slack"
 )
 
+var errUnsupportedEvent = errors.New("unsupported event type")
+
 type UnfurlEvent struct {
-	Token     string            `json:"token"`
-	Event     UnfurlEventDetail `json:"event"`
-	Type      string            `json:"type"`
-	EventID   string            `json:"event_id"`
-	EventTime int               `json:"event_time"`
+	Token              string               `json:"token"`
+	TeamID             string               `json:"team_id,omitempty"`
+	EnterpriseID       string               `json:"enterprise_id,omitempty"`
+	Authorizations     []EventAuthorization `json:"authorizations,omitempty"`
+	IsExtSharedChannel bool                 `json:"is_ext_shared_channel,omitempty"`
+	Event              UnfurlEventDetail    `json:"event"`
+	Type               string               `json:"type"`
+	EventID            string               `json:"event_id"`
+	EventTime          int                  `json:"event_time"`
+}
+
+// EventAuthorization describes an installation an event was delivered for.
+type EventAuthorization struct {
+	EnterpriseID        string `json:"enterprise_id,omitempty"`
+	TeamID              string `json:"team_id,omitempty"`
+	UserID              string `json:"user_id,omitempty"`
+	IsBot               bool   `json:"is_bot,omitempty"`
+	IsEnterpriseInstall bool   `json:"is_enterprise_install,omitempty"`
+}
+
+// installation returns the key of our installation that received the
+// event. The top level team_id is the team the event happened in, which
+// for Slack Connect channels can be another organisation, so the event's
+// authorizations are preferred when present.
+func (e *UnfurlEvent) installation() teamKey {
+	if len(e.Authorizations) > 0 {
+		a := e.Authorizations[0]
+		if a.IsEnterpriseInstall {
+			return teamKey{EnterpriseID: a.EnterpriseID}
+		}
+		return teamKey{EnterpriseID: a.EnterpriseID, TeamID: a.TeamID}
+	}
+
+	return teamKey{EnterpriseID: e.EnterpriseID, TeamID: e.TeamID}
 }
 
 type UnfurlEventDetail struct {
@@ -27,6 +60,15 @@ type UnfurlEventDetail struct {
 	MessageTimestamp string            `json:"message_ts"`
 	ThreadTimestamp  string            `json:"thread_ts,omitempty"`
 	Links            []UnfurlEventLink `json:"links"`
+	Tokens           *RevokedTokens    `json:"tokens,omitempty"`
+	Tab              string            `json:"tab,omitempty"`
+}
+
+// RevokedTokens lists the user ids whose tokens were revoked, for
+// tokens_revoked events.
+type RevokedTokens struct {
+	OAuth []string `json:"oauth,omitempty"`
+	Bot   []string `json:"bot,omitempty"`
 }
 
 type UnfurlEventLink struct {
@@ -41,13 +83,47 @@ type UnfurlBody struct {
 	Unfurls   map[string]Unfurl `json:"unfurls"`
 }
 type Unfurl struct {
-	Blocks []slack.SectionBlock `json:"blocks"`
+	Blocks []slack.Block `json:"blocks"`
 }
 
 func (h *handler) handleEventCallback(ctx context.Context, msg *UnfurlEvent) error {
-	if msg.Event.Type != "link_shared" {
-		log.Printf("Event isn't link_shared")
-		return fmt.Errorf("unsupported event type %s", msg.Event.Type)
+	switch msg.Event.Type {
+	case "link_shared":
+		return h.handleLinkShared(ctx, msg)
+	case "app_uninstalled":
+		return h.handleUninstall(ctx, msg, "app uninstalled")
+	case "tokens_revoked":
+		if msg.Event.Tokens == nil || len(msg.Event.Tokens.Bot) == 0 {
+			// we only hold bot tokens
+			log.Printf("Ignoring tokens_revoked without bot tokens for team %s", msg.TeamID)
+			return nil
+		}
+		return h.handleTokensRevoked(ctx, msg)
+	case "app_home_opened":
+		log.Printf("App home opened by %s in team %s (tab %s)", msg.Event.User, msg.TeamID, msg.Event.Tab)
+		return nil
+	}
+
+	log.Printf("Unsupported event type %s", msg.Event.Type)
+	return errUnsupportedEvent
+}
+
+func (h *handler) handleLinkShared(ctx context.Context, msg *UnfurlEvent) error {
+	key := msg.installation()
+
+	team := h.teamForRequest(ctx, msg.Token, key)
+	if team == nil {
+		return errUnknownTeam
+	}
+
+	if q := h.checkQuota(ctx, key, msg.Event.User); q != nil {
+		log.Printf("User %s in team %s is over quota, not unfurling", msg.Event.User, key)
+		h.notifyQuotaExceeded(ctx, team, msg.Event.Channel, msg.Event.User, q)
+		return nil
+	}
+
+	if msg.IsExtSharedChannel && key.TeamID != msg.TeamID {
+		log.Printf("Link shared in external channel %s by team %s, unfurling as %s", msg.Event.Channel, msg.TeamID, key)
 	}
 
 	ssMsg := &SQSSlackMessage{
@@ -64,78 +140,124 @@ func (h *handler) handleEventCallback(ctx context.Context, msg *UnfurlEvent) err
 	return nil
 }
 
-func (h *handler) processSQSUnfurlMessage(ctx context.Context, msg *SQSSlackMessage) {
+func (h *handler) handleUninstall(ctx context.Context, msg *UnfurlEvent, reason string) error {
+	key := msg.installation()
+
+	if err := h.purgeTeam(ctx, key); err != nil {
+		log.Printf("Error purging team %s: %s", key, err)
+		return err
+	}
+
+	h.recordAudit(ctx, &AuditEntry{
+		Action:       msg.Event.Type,
+		TeamID:       key.TeamID,
+		EnterpriseID: key.EnterpriseID,
+		EventID:      msg.EventID,
+		Detail:       reason,
+	})
+
+	return nil
+}
+
+// handleTokensRevoked purges the installation only if its own bot was
+// among those revoked. The event lists the user ids whose tokens went.
+func (h *handler) handleTokensRevoked(ctx context.Context, msg *UnfurlEvent) error {
+	key := msg.installation()
+
+	team, err := h.getStoredTeam(ctx, key)
+	if err == errNotFound {
+		log.Printf("Ignoring tokens_revoked for team %s, which isn't installed", key)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, id := range msg.Event.Tokens.Bot {
+		if team.BotUserID != "" && id == team.BotUserID {
+			return h.handleUninstall(ctx, msg, fmt.Sprintf("bot token revoked for %s", id))
+		}
+	}
+
+	log.Printf("Ignoring tokens_revoked for team %s, our bot %s wasn't revoked (%s)", key, team.BotUserID, strings.Join(msg.Event.Tokens.Bot, ","))
+	return nil
+}
+
+func (h *handler) processSQSUnfurlMessage(ctx context.Context, msg *SQSSlackMessage) error {
 	unfurls := make(map[string]Unfurl)
 
 	evt := msg.UnfurlEvent.Event
+	team := h.teamForRequest(ctx, msg.UnfurlEvent.Token, msg.UnfurlEvent.installation())
+	if team == nil {
+		return permanent(errUnknownTeam)
+	}
+
+	r := h.config.rendererForTeam(team)
 
 	for _, link := range evt.Links {
 		meta, err := h.fetchInsta(ctx, link.URL, 0)
 
 		if err != nil {
-			log.Printf("Error while fetching data from %s: %s", link.URL, err)
-			return
+			return fmt.Errorf("fetching data from %s: %w", link.URL, err)
 		}
 
 		log.Printf("Fetched %s; meta: %#v", link.URL, meta)
 
 		unfurls[link.URL] = Unfurl{
-			Blocks: []slack.SectionBlock{
-				slack.SectionBlock{
-					Type: slack.MBTSection,
-					Text: &slack.TextBlockObject{
-						Type: slack.MarkdownType,
-						Text: fmt.Sprintf("%s - [link](%s)", meta.Title, meta.URL),
-					},
-					Accessory: &slack.Accessory{
-						ImageElement: &slack.ImageBlockElement{
-							Type:     slack.METImage,
-							ImageURL: meta.ImageURL,
-						},
-					},
-				},
-			},
+			Blocks: r.unfurlBlocks(meta),
 		}
 	}
 
-	if team := h.config.TeamByRequestToken(msg.UnfurlEvent.Token); team != nil {
-		unfurlBody := UnfurlBody{
-			Token:     team.OauthToken,
-			Channel:   evt.Channel,
-			Timestamp: evt.MessageTimestamp,
-			Unfurls:   unfurls,
-		}
+	token, err := h.botToken(ctx, team)
+	if err != nil {
+		return fmt.Errorf("getting bot token for team %s: %w", team.key(), err)
+	}
 
-		postUnfurlResponse(ctx, team.OauthToken, unfurlBody)
+	unfurlBody := UnfurlBody{
+		Token:     token,
+		Channel:   evt.Channel,
+		Timestamp: evt.MessageTimestamp,
+		Unfurls:   unfurls,
 	}
+
+	return h.postUnfurlResponse(ctx, token, unfurlBody)
 }
 
-func postUnfurlResponse(ctx context.Context, otkn string, msg UnfurlBody) {
+func (h *handler) postUnfurlResponse(ctx context.Context, otkn string, msg UnfurlBody) (err error) {
+	defer h.observeSlackCall("chat.unfurl", time.Now(), &err)
+
 	data, err := json.Marshal(msg)
 	if err != nil {
-		log.Printf("postUnfurlResponse marshal error: %s", err)
-		return
+		return permanent(fmt.Errorf("postUnfurlResponse marshal error: %w", err))
 	}
 
-	const url = "https://slack.com/api/chat.unfurl"
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.slackAPIURL()+"chat.unfurl", bytes.NewReader(data))
 	if err != nil {
-		log.Printf("postUnfurlResponse request error: %s", err)
-		return
+		return permanent(fmt.Errorf("postUnfurlResponse request error: %w", err))
 	}
 	req.Header.Set("content-type", "application/json")
 	req.Header.Set("authorization", fmt.Sprintf("Bearer %s", otkn))
 
-	client := &http.Client{
-		Timeout: externalTimeout,
-	}
-
 	log.Printf("Sending unfurls request: %#v", msg)
 
-	_, err = client.Do(req)
+	clients, err := h.http()
 	if err != nil {
-		log.Printf("postUnfurlResponse execute error: %s", err)
-		return
+		return err
 	}
+
+	resp, err := clients.slack.Do(req)
+	if err != nil {
+		return fmt.Errorf("postUnfurlResponse execute error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return statusError("postUnfurlResponse", resp.StatusCode)
+	}
+
+	status := &slackAPIResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(status); err != nil {
+		return fmt.Errorf("postUnfurlResponse decode error: %w", err)
+	}
+
+	return status.err("chat.unfurl")
 }
@@ -0,0 +1,144 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	installPath       = "/slack/install"
+	oauthCallbackPath = "/slack/oauth/callback"
+
+	oauthAuthorizeURL = "https://slack.com/oauth/v2/authorize"
+	oauthStateTTL     = 10 * time.Minute
+)
+
+var defaultOAuthScopes = []string{"commands", "links:read", "links:write"}
+
+func oauthStateKey(state string) string {
+	return "oauth_state/" + state
+}
+
+func (h *handler) handleInstall(ctx context.Context) (*events.APIGatewayProxyResponse, error) {
+	oc := h.config.OAuth
+	if oc == nil || oc.ClientID == "" {
+		return NewAPIResponse(404, "text/plain", "Install not configured"), nil
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	state := hex.EncodeToString(buf)
+
+	if err := h.store.Put(ctx, oauthStateKey(state), []byte("1"), oauthStateTTL); err != nil {
+		log.Printf("Error storing oauth state: %s", err)
+		return NewAPIResponse(500, "text/plain", "Failed to start install"), nil
+	}
+
+	scopes := oc.Scopes
+	if len(scopes) == 0 {
+		scopes = defaultOAuthScopes
+	}
+
+	q := url.Values{
+		"client_id": {oc.ClientID},
+		"scope":     {strings.Join(scopes, ",")},
+		"state":     {state},
+	}
+	if oc.RedirectURL != "" {
+		q.Set("redirect_uri", oc.RedirectURL)
+	}
+
+	return NewRedirectResponse(oauthAuthorizeURL + "?" + q.Encode()), nil
+}
+
+func (h *handler) handleOAuthCallback(ctx context.Context, query map[string]string) (*events.APIGatewayProxyResponse, error) {
+	oc := h.config.OAuth
+	if oc == nil || oc.ClientID == "" {
+		return NewAPIResponse(404, "text/plain", "Install not configured"), nil
+	}
+
+	if e := query["error"]; e != "" {
+		log.Printf("OAuth callback error: %s", e)
+		return NewHTMLResponse(400, "Install cancelled", fmt.Sprintf("Slack said: %s", e)), nil
+	}
+
+	state := query["state"]
+	if state == "" {
+		return NewHTMLResponse(400, "Install failed", "Missing state, please start again."), nil
+	}
+	if _, err := h.store.Get(ctx, oauthStateKey(state)); err != nil {
+		log.Printf("Unknown oauth state %s: %s", state, err)
+		return NewHTMLResponse(400, "Install failed", "This install link has expired, please start again."), nil
+	}
+	if err := h.store.Delete(ctx, oauthStateKey(state)); err != nil {
+		log.Printf("Error deleting oauth state %s: %s", state, err)
+	}
+
+	values := url.Values{
+		"client_id":     {oc.ClientID},
+		"client_secret": {oc.ClientSecret},
+		"code":          {query["code"]},
+	}
+	if oc.RedirectURL != "" {
+		values.Set("redirect_uri", oc.RedirectURL)
+	}
+
+	resp := &oauthV2Response{}
+	if err := h.callSlackForm(ctx, "oauth.v2.access", values, resp); err != nil {
+		log.Printf("Error exchanging oauth code: %s", err)
+		return NewHTMLResponse(502, "Install failed", "Couldn't complete the install with Slack, please try again."), nil
+	}
+
+	team := teamFromOAuthResponse(resp)
+
+	if err := h.putStoredTeam(ctx, team); err != nil {
+		log.Printf("Error storing team %s: %s", team.key(), err)
+		return NewHTMLResponse(500, "Install failed", "Couldn't save the installation, please try again."), nil
+	}
+
+	log.Printf("Installed for team %s (%s)", team.key(), team.Name)
+
+	h.recordAudit(ctx, &AuditEntry{
+		Action:       "installed",
+		TeamID:       team.ID,
+		EnterpriseID: team.EnterpriseID,
+		Detail:       fmt.Sprintf("scopes %s", team.Scope),
+	})
+
+	return NewHTMLResponse(200, "Installed", fmt.Sprintf("Installed to %s. Try %s in a channel.", team.Name, slashCommand)), nil
+}
+
+func teamFromOAuthResponse(resp *oauthV2Response) *TeamInfo {
+	team := &TeamInfo{
+		BotUserID:   resp.BotUserID,
+		Scope:       resp.Scope,
+		InstalledAt: time.Now().Unix(),
+	}
+
+	team.setToken(resp)
+
+	// org-wide installs are for the enterprise rather than one workspace
+	if resp.Team != nil && !resp.IsEnterpriseInstall {
+		team.ID = resp.Team.ID
+		team.Name = resp.Team.Name
+	}
+
+	if resp.Enterprise != nil {
+		team.EnterpriseID = resp.Enterprise.ID
+		if team.Name == "" {
+			team.Name = resp.Enterprise.Name
+		}
+	}
+
+	return team
+}
@@ -26,12 +26,19 @@ func (h *handler) handleSlashCommand(ctx context.Context, body url.Values) *slac
 		userID      = body.Get("user_id")
 		instaURL    string
 		instaOffset int
+		start       = time.Now()
+		result      = "usage"
 	)
 
+	defer func() {
+		h.metrics.observe(metricSlashCommand, time.Since(start).Seconds(), result)
+	}()
+
 	log.Printf("Got slash command '%s' from %s", text, userID)
 
 	if !strings.HasPrefix(responseURL, "https://") {
 		log.Printf("Bad response_url %s", responseURL)
+		result = "bad_request"
 		return simpleEphemeralMessage("bad request (response_url)")
 	}
 
@@ -57,12 +64,36 @@ func (h *handler) handleSlashCommand(ctx context.Context, body url.Values) *slac
 		}
 	}
 
+	// claim before charging quota, so slack's retries and double
+	// submits don't count
+	dedup := body.Get("trigger_id")
+	if dedup == "" {
+		dedup = dedupID(responseURL)
+	}
+
+	if !h.claimOnce(ctx, "slash", dedup) {
+		log.Printf("Skipping duplicate slash command %s", dedup)
+		result = "duplicate"
+		return simpleEphemeralMessage(fmt.Sprintf("Already fetching %s ...", instaURL))
+	}
+
+	team := teamKey{EnterpriseID: body.Get("enterprise_id"), TeamID: body.Get("team_id")}
+	if q := h.checkQuota(ctx, team, userID); q != nil {
+		log.Printf("User %s in team %s is over quota", userID, team)
+		result = "over_quota"
+		return simpleEphemeralMessage(q.message())
+	}
+
 	ssMsg := &SQSSlackMessage{
 		RequestTimestamp: time.Now().Unix(),
 		Type:             SQSMessageTypeSlash,
 		SlashMessage: &SlashMessage{
 			ResponseURL:   responseURL,
 			UserID:        userID,
+			ChannelID:     body.Get("channel_id"),
+			Token:         body.Get("token"),
+			TeamID:        body.Get("team_id"),
+			EnterpriseID:  body.Get("enterprise_id"),
 			InstagramURL:  instaURL,
 			SelectedIndex: instaOffset,
 		},
@@ -70,82 +101,59 @@ func (h *handler) handleSlashCommand(ctx context.Context, body url.Values) *slac
 
 	if err := h.enqueueMessage(ctx, ssMsg); err != nil {
 		log.Printf("Error enqueueing slash message: %s", err)
+		h.releaseClaim(ctx, "slash", dedup)
+		result = "enqueue_failed"
 		return simpleEphemeralMessage("Failed to enqueue request")
 	}
 
+	result = "queued"
 	return simpleEphemeralMessage(fmt.Sprintf("Fetching %s ...", s[0]))
 }
 
-func (h *handler) processSQSSlashMessage(ctx context.Context, msg *SQSSlackMessage) {
+func (h *handler) processSQSSlashMessage(ctx context.Context, msg *SQSSlackMessage) error {
 	meta, err := h.fetchInsta(ctx, msg.SlashMessage.InstagramURL, msg.SlashMessage.SelectedIndex)
 
 	if err != nil {
-		log.Printf("Error while fetching data from %s: %s", msg.SlashMessage.InstagramURL, err)
-		h.postSlashResponse(ctx, msg.SlashMessage.ResponseURL, simpleEphemeralMessage("Error fetching data from instagram"))
-		return
+		return fmt.Errorf("fetching data from %s: %w", msg.SlashMessage.InstagramURL, err)
 	}
 
 	log.Printf("Fetched %s; meta: %#v", msg.SlashMessage.InstagramURL, meta)
 
-	h.postSlashResponse(ctx, msg.SlashMessage.ResponseURL, h.slashResponse(msg.SlashMessage.UserID, meta))
-}
-
-func (h *handler) slashResponse(userID string, meta *InstaMeta) *slack.Msg {
-	text := fmt.Sprintf("<@%s> shared this instagram post", userID)
-
-	extra := make([]string, 0, 0)
-
-	if meta.ImageIsVideo {
-		extra = append(extra, "video")
-	}
-
-	if meta.PartCount > 1 {
-		extra = append(extra, fmt.Sprintf("%d parts", meta.PartCount))
-	}
+	team := h.teamForRequest(ctx, msg.SlashMessage.Token, msg.SlashMessage.teamKey())
 
-	if len(extra) > 0 {
-		text = fmt.Sprintf("%s (%s)", text, strings.Join(extra, ", "))
-	}
-
-	return &slack.Msg{
-		ResponseType: slack.ResponseTypeInChannel,
-		Text:         text,
-		Attachments: []slack.Attachment{
-			slack.Attachment{
-				Title:      meta.Title,
-				TitleLink:  meta.URL,
-				ImageURL:   meta.ImageURL,
-				Footer:     fmt.Sprintf("@%s", meta.Username),
-				FooterIcon: meta.UserPicURL,
-				Fallback:   fmt.Sprintf("%s by @%s (%s)", meta.URL, meta.Username, meta.Title),
-			},
-		},
-	}
+	return h.postSlashResponse(ctx, msg.SlashMessage.ResponseURL, h.config.rendererForTeam(team).slashMessage(msg.SlashMessage.UserID, meta))
 }
 
-func (h *handler) postSlashResponse(ctx context.Context, responseURL string, msg *slack.Msg) {
+func (h *handler) postSlashResponse(ctx context.Context, responseURL string, msg *slack.Msg) (err error) {
+	defer h.observeSlackCall("response_url", time.Now(), &err)
+
 	data, err := json.Marshal(msg)
 	if err != nil {
-		log.Printf("postSlashResponse marshal error: %s", err)
-		return
+		return permanent(fmt.Errorf("postSlashResponse marshal error: %w", err))
 	}
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, responseURL, bytes.NewReader(data))
 	if err != nil {
-		log.Printf("postSlashResponse request error: %s", err)
-		return
+		return permanent(fmt.Errorf("postSlashResponse request error: %w", err))
 	}
 	req.Header.Set("content-type", "application/json")
 
-	client := &http.Client{
-		Timeout: externalTimeout,
-	}
-
 	log.Printf("Sending slash command response: %#v", msg)
 
-	_, err = client.Do(req)
+	clients, err := h.http()
 	if err != nil {
-		log.Printf("postSlashResponse execute error: %s", err)
-		return
+		return err
 	}
+
+	resp, err := clients.slack.Do(req)
+	if err != nil {
+		return fmt.Errorf("postSlashResponse execute error: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return statusError("postSlashResponse", resp.StatusCode)
+	}
+
+	return nil
 }
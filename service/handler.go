@@ -2,22 +2,25 @@ package service
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go/service/sqs"
 )
 
 const (
 	externalTimeout = 20 * time.Second
-	maxLag          = 30 * time.Second
+
+	defaultSQSWorkers = 4
+	sqsDeadlineMargin = 2 * time.Second
 
 	slashCommand = "/insta"
 )
@@ -40,59 +43,59 @@ type ChallengeRequest struct {
 
 type handler struct {
 	config *Config
-	sqs    *sqs.SQS
-}
+	queue  Queue
+	store  Store
 
-func NewHandler(config *Config, sqs *sqs.SQS) lambda.Handler {
-	return &handler{
-		config: config,
-		sqs:    sqs,
-	}
-}
+	// refreshLocks holds a *sync.Mutex per team, serializing its token
+	// refreshes within the process
+	refreshLocks sync.Map
 
-func (h *handler) Invoke(ctx context.Context, payload []byte) ([]byte, error) {
-	// try http first
-	apiReq := &events.APIGatewayProxyRequest{}
-	if err := json.Unmarshal(payload, apiReq); err == nil && len(apiReq.Body) > 0 {
-		resp, err := h.handleAPIRequest(ctx, apiReq)
-		if err != nil {
-			log.Printf("Error from api request handler: %s", err)
-			return nil, err
-		}
+	// sessionNext picks the next instagram session round robin.
+	sessionNext uint32
 
-		data, err := json.Marshal(resp)
-		return data, err
-	}
+	instaOnce sync.Once
+	insta     *instaClient
 
-	// try sqs next
-	sqsEvent := &events.SQSEvent{}
-	if err := json.Unmarshal(payload, sqsEvent); err == nil && len(sqsEvent.Records) > 0 {
-		err := h.handleSQSEvent(ctx, sqsEvent)
-		if err != nil {
-			log.Printf("Error from sqs event handler: %s", err)
-		}
+	// transport replaces the outbound http transport when set
+	transport  http.RoundTripper
+	httpOnce   sync.Once
+	clients    *httpClients
+	clientsErr error
+
+	metrics *metrics
+	// emf receives metrics at the end of each invocation when set
+	emf io.Writer
+}
 
-		return nil, err
+func NewHandler(config *Config, queue Queue, store Store, opts ...HandlerOption) lambda.Handler {
+	h := &handler{
+		config:  config,
+		queue:   queue,
+		store:   store,
+		metrics: newMetrics(),
 	}
 
-	// unsupported
-	return nil, fmt.Errorf("Unsupported lambda payload")
-}
+	for _, opt := range opts {
+		opt(h)
+	}
 
-func (h *handler) handleAPIRequest(ctx context.Context, evt *events.APIGatewayProxyRequest) (*events.APIGatewayProxyResponse, error) {
-	var bodyString string
+	return h
+}
 
-	if evt.IsBase64Encoded {
-		dec, derr := base64.StdEncoding.DecodeString(evt.Body)
-		if derr != nil {
-			return NewSlackTextResponse(400, "Bad api request body (base64 decode fail)"), derr
+func (h *handler) handleAPIRequest(ctx context.Context, evt *httpRequest) (*events.APIGatewayProxyResponse, error) {
+	if evt.Method == "GET" {
+		switch {
+		case strings.HasSuffix(evt.Path, installPath):
+			return h.handleInstall(ctx)
+		case strings.HasSuffix(evt.Path, oauthCallbackPath):
+			return h.handleOAuthCallback(ctx, evt.Query)
 		}
 
-		bodyString = string(dec)
-	} else {
-		bodyString = evt.Body
+		return NewAPIResponse(404, "text/plain", "Not found"), nil
 	}
 
+	bodyString := evt.Body
+
 	ct := getMapValueInsensitive(evt.Headers, "content-type")
 
 	log.Printf("API request type %s body %s", ct, bodyString)
@@ -102,7 +105,7 @@ func (h *handler) handleAPIRequest(ctx context.Context, evt *events.APIGatewayPr
 		return h.handleAPIFormRequest(ctx, bodyString)
 	} else if ct == "application/json" {
 		// challenge or event
-		resp, err := h.handleAPIJSONRequest(ctx, bodyString)
+		resp, err := h.handleAPIJSONRequest(ctx, bodyString, evt.Headers)
 		if err == nil {
 			return resp, nil
 		}
@@ -121,7 +124,8 @@ func (h *handler) handleAPIFormRequest(ctx context.Context, bodyString string) (
 	}
 
 	tkn := bodyValues.Get("token")
-	if info := h.config.TeamByRequestToken(tkn); info == nil {
+	key := teamKey{EnterpriseID: bodyValues.Get("enterprise_id"), TeamID: bodyValues.Get("team_id")}
+	if info := h.teamForRequest(ctx, tkn, key); info == nil {
 		return NewSlackTextResponse(400, fmt.Sprintf("Bad slack api request token (%s)", tkn)), nil
 	}
 
@@ -135,12 +139,12 @@ func (h *handler) handleAPIFormRequest(ctx context.Context, bodyString string) (
 	return NewSlackMessageResponse(200, msg), nil
 }
 
-func (h *handler) handleAPIJSONRequest(ctx context.Context, bodyString string) (*events.APIGatewayProxyResponse, error) {
+func (h *handler) handleAPIJSONRequest(ctx context.Context, bodyString string, headers map[string]string) (*events.APIGatewayProxyResponse, error) {
 	// challenge?
 	challengeReq := &ChallengeRequest{}
 	if err := json.Unmarshal([]byte(bodyString), challengeReq); err == nil && challengeReq.Type == "url_verification" {
 		tkn := challengeReq.Token
-		if info := h.config.TeamByRequestToken(tkn); info == nil {
+		if !h.config.validRequestToken(tkn) {
 			return NewAPIResponse(400, "text/plain", fmt.Sprintf("Bad slack api request token (%s)", tkn)), nil
 		}
 
@@ -151,11 +155,26 @@ func (h *handler) handleAPIJSONRequest(ctx context.Context, bodyString string) (
 	msg := &UnfurlEvent{}
 	if err := json.Unmarshal([]byte(bodyString), msg); err == nil && msg.Type == "event_callback" {
 		tkn := msg.Token
-		if info := h.config.TeamByRequestToken(tkn); info == nil {
+		if !h.config.validRequestToken(tkn) {
 			return NewAPIResponse(400, "text/plain", fmt.Sprintf("Bad slack api request token (%s)", tkn)), nil
 		}
 
-		if err = h.handleEventCallback(ctx, msg); err != nil {
+		if n := getMapValueInsensitive(headers, "x-slack-retry-num"); n != "" {
+			log.Printf("Slack retry %s of event %s (%s)", n, msg.EventID, getMapValueInsensitive(headers, "x-slack-retry-reason"))
+		}
+
+		if !h.claimOnce(ctx, "event", msg.EventID) {
+			log.Printf("Skipping duplicate event %s", msg.EventID)
+			return NewAPIResponse(200, "text/plain", "Duplicate event"), nil
+		}
+
+		if err = h.handleEventCallback(ctx, msg); err == errUnknownTeam {
+			return h.noRetry(NewAPIResponse(400, "text/plain", fmt.Sprintf("Unknown team (%s)", msg.TeamID))), nil
+		} else if err == errUnsupportedEvent {
+			return h.noRetry(NewAPIResponse(400, "text/plain", fmt.Sprintf("Unsupported event (%s)", msg.Event.Type))), nil
+		} else if err != nil {
+			// let slack's retry through
+			h.releaseClaim(ctx, "event", msg.EventID)
 			return NewAPIResponse(500, "text/plain", "Error handling event"), nil
 		}
 
@@ -165,9 +184,80 @@ func (h *handler) handleAPIJSONRequest(ctx context.Context, bodyString string) (
 	return nil, fmt.Errorf("Unsupported json request")
 }
 
-func (h *handler) handleSQSEvent(ctx context.Context, evt *events.SQSEvent) error {
-	for _, r := range evt.Records {
-		h.handleSQSMessage(ctx, r)
+// noRetry marks a failure response as permanent when configured to, so
+// slack doesn't retry it.
+func (h *handler) noRetry(resp *events.APIGatewayProxyResponse) *events.APIGatewayProxyResponse {
+	if h.config.SlackNoRetry {
+		resp.Headers["X-Slack-No-Retry"] = "1"
+	}
+	return resp
+}
+
+// handleSQSEvent processes a batch with a bounded pool of workers. Records
+// for the same channel are handled one at a time in batch order; once one
+// fails, the rest of its channel is sent back for retry too so they can't
+// overtake it. Work stops shortly before the lambda deadline, and anything
+// unfinished is reported as failed.
+func (h *handler) handleSQSEvent(ctx context.Context, evt *events.SQSEvent) *SQSEventResponse {
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline.Add(-sqsDeadlineMargin))
+		defer cancel()
+	}
+
+	failed := make([]bool, len(evt.Records))
+	sem := make(chan struct{}, h.sqsWorkers())
+	wg := sync.WaitGroup{}
+
+	for _, group := range groupSQSRecords(evt.Records) {
+		wg.Add(1)
+
+		go func(group []int) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+			}
+
+			for i, idx := range group {
+				if ctx.Err() != nil {
+					log.Printf("Out of time, returning %d messages to the queue", len(group)-i)
+				} else if err := h.handleSQSMessage(ctx, evt.Records[idx]); err == nil {
+					continue
+				}
+
+				for _, rest := range group[i:] {
+					failed[rest] = true
+				}
+				return
+			}
+		}(group)
+	}
+
+	wg.Wait()
+
+	resp := &SQSEventResponse{
+		BatchItemFailures: []SQSBatchItemFailure{},
+	}
+
+	for i, r := range evt.Records {
+		if failed[i] {
+			resp.BatchItemFailures = append(resp.BatchItemFailures, SQSBatchItemFailure{ItemIdentifier: r.MessageId})
+		}
+	}
+
+	if n := len(resp.BatchItemFailures); n > 0 {
+		log.Printf("%d of %d sqs messages failed", n, len(evt.Records))
+	}
+
+	return resp
+}
+
+func (h *handler) sqsWorkers() int {
+	if h.config.SQSWorkers > 0 {
+		return h.config.SQSWorkers
 	}
-	return nil
+	return defaultSQSWorkers
 }
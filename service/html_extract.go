@@ -0,0 +1,452 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"html"
+	"io"
+	"strings"
+)
+
+const (
+	// maxInstaPageBytes caps how much of a page is read. Post data is
+	// usually well within the first megabyte.
+	maxInstaPageBytes = 4 << 20
+
+	// pagePrefixBytes of the raw page are kept for diagnostics.
+	pagePrefixBytes = 16 << 10
+)
+
+var (
+	additionalDataMarker = []byte(`{"graphql":{"shortcode_media":`)
+	sharedDataMarker     = []byte(`window._sharedData`)
+
+	loginWallMarkers = [][]byte{[]byte(`"LoginAndSignupPage"`), []byte(`"loginPage"`)}
+)
+
+// pageData is what the extraction strategies need from a post page,
+// collected in one pass by scanPage.
+type pageData struct {
+	Title string
+	// Meta maps meta tag property (or name) to content.
+	Meta map[string]string
+
+	// AdditionalData and SharedData are the bodies of the scripts holding
+	// those blobs.
+	AdditionalData []byte
+	SharedData     []byte
+
+	LoginWall bool
+	// Truncated is set when the byte cap was hit before the end.
+	Truncated bool
+
+	// Prefix is the start of the raw page.
+	Prefix []byte
+}
+
+// done reports whether the rest of the page can be skipped: we have the
+// title and post data. Newer pages have a _sharedData script without the
+// post, followed by the additional data script that has it.
+func (p *pageData) done() bool {
+	if p.Title == "" {
+		return false
+	}
+	return p.AdditionalData != nil || bytes.Contains(p.SharedData, additionalDataMarker)
+}
+
+// pageReader counts bytes and keeps the first few for pageData.Prefix.
+type pageReader struct {
+	r      io.Reader
+	prefix []byte
+}
+
+func (pr *pageReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	if room := pagePrefixBytes - len(pr.prefix); room > 0 && n > 0 {
+		if room > n {
+			room = n
+		}
+		pr.prefix = append(pr.prefix, b[:room]...)
+	}
+	return n, err
+}
+
+// scanPage tokenizes html from r just far enough to find the title, meta
+// tags and post data scripts, reading at most limit bytes. It stops as
+// soon as it has the title and a data script. Malformed markup is skipped
+// over rather than treated as an error.
+func scanPage(r io.Reader, limit int64) (*pageData, error) {
+	pr := &pageReader{r: io.LimitReader(r, limit+1)}
+	s := &pageScanner{r: bufio.NewReaderSize(pr, 32<<10)}
+	p := &pageData{Meta: make(map[string]string)}
+
+	err := s.scan(p)
+
+	p.Prefix = pr.prefix
+	if s.read > limit {
+		p.Truncated = true
+		err = nil
+	}
+	if err == io.EOF || err == errScanDone {
+		err = nil
+	}
+
+	return p, err
+}
+
+var errScanDone = errors.New("scan done")
+
+type pageScanner struct {
+	r    *bufio.Reader
+	read int64
+}
+
+func (s *pageScanner) readByte() (byte, error) {
+	b, err := s.r.ReadByte()
+	if err == nil {
+		s.read++
+	}
+	return b, err
+}
+
+func (s *pageScanner) scan(p *pageData) error {
+	var (
+		inTitle bool
+		title   []byte
+	)
+
+	for {
+		text, err := s.readUntil('<', inTitle)
+		if inTitle {
+			title = append(title, text...)
+		}
+		if err != nil {
+			return err
+		}
+
+		b, err := s.readByte()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case b == '!':
+			if err := s.skipDeclaration(); err != nil {
+				return err
+			}
+
+		case b == '/':
+			name, err := s.readTagName(0)
+			if err != nil {
+				return err
+			}
+			if err := s.skipTag(); err != nil {
+				return err
+			}
+
+			switch name {
+			case "title":
+				if inTitle {
+					inTitle = false
+					if p.Title == "" {
+						p.Title = strings.TrimSpace(html.UnescapeString(string(title)))
+					}
+				}
+			case "html":
+				return errScanDone
+			}
+
+		case isASCIILetter(b):
+			name, err := s.readTagName(b)
+			if err != nil {
+				return err
+			}
+			attrs, err := s.readAttrs()
+			if err != nil {
+				return err
+			}
+
+			switch name {
+			case "title":
+				inTitle = p.Title == ""
+				title = title[:0]
+			case "meta":
+				key := attrs["property"]
+				if key == "" {
+					key = attrs["name"]
+				}
+				if key != "" {
+					if _, ok := p.Meta[key]; !ok {
+						p.Meta[key] = attrs["content"]
+					}
+				}
+			case "script":
+				body, err := s.readScript()
+				p.addScript(body)
+				if err != nil {
+					return err
+				}
+			}
+
+		default:
+			// a stray '<' in text
+			if inTitle {
+				title = append(title, '<', b)
+			}
+			continue
+		}
+
+		if p.done() {
+			return errScanDone
+		}
+	}
+}
+
+func (p *pageData) addScript(body []byte) {
+	switch {
+	// shared data embeds the same graphql object, so check for it first
+	case bytes.Contains(body, sharedDataMarker):
+		if p.SharedData == nil {
+			p.SharedData = body
+		}
+	case p.AdditionalData == nil && bytes.Contains(body, additionalDataMarker):
+		p.AdditionalData = body
+	}
+
+	if !p.LoginWall {
+		for _, m := range loginWallMarkers {
+			if bytes.Contains(body, m) {
+				p.LoginWall = true
+				break
+			}
+		}
+	}
+}
+
+// readUntil returns the bytes before delim, consuming delim. Unless keep
+// is set, only the last buffer's worth is returned and it's only valid
+// until the next read.
+func (s *pageScanner) readUntil(delim byte, keep bool) ([]byte, error) {
+	var kept []byte
+
+	b, err := s.r.ReadSlice(delim)
+	for err == bufio.ErrBufferFull {
+		s.read += int64(len(b))
+		if keep {
+			kept = append(kept, b...)
+		}
+		b, err = s.r.ReadSlice(delim)
+	}
+	s.read += int64(len(b))
+
+	if err == nil {
+		b = b[:len(b)-1]
+	}
+	if keep {
+		b = append(kept, b...)
+	}
+	return b, err
+}
+
+func (s *pageScanner) skipDeclaration() error {
+	peek, _ := s.r.Peek(2)
+	if string(peek) != "--" {
+		return s.skipTag()
+	}
+
+	// comment: skip to -->
+	dashes := 0
+	for {
+		b, err := s.readByte()
+		if err != nil {
+			return err
+		}
+		if b == '>' && dashes >= 4 {
+			return nil
+		}
+		if b == '-' {
+			dashes++
+		} else if dashes > 2 {
+			dashes = 2
+		}
+	}
+}
+
+func (s *pageScanner) skipTag() error {
+	_, err := s.readUntil('>', false)
+	return err
+}
+
+func (s *pageScanner) readTagName(first byte) (string, error) {
+	var name []byte
+	if first != 0 {
+		name = append(name, toLowerASCII(first))
+	}
+
+	for {
+		b, err := s.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if !isASCIILetter(b) && !(b >= '0' && b <= '9') && b != '-' {
+			s.r.UnreadByte()
+			return string(name), nil
+		}
+		s.read++
+		name = append(name, toLowerASCII(b))
+	}
+}
+
+// readAttrs reads a start tag's attributes up to and including '>'.
+func (s *pageScanner) readAttrs() (map[string]string, error) {
+	attrs := make(map[string]string)
+
+	for {
+		b, err := s.readByte()
+		if err != nil {
+			return attrs, err
+		}
+
+		switch {
+		case b == '>':
+			return attrs, nil
+		case b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\f' || b == '/':
+			continue
+		}
+
+		name := []byte{toLowerASCII(b)}
+		for {
+			b, err = s.readByte()
+			if err != nil {
+				return attrs, err
+			}
+			if b == '=' || b == '>' || b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '/' {
+				break
+			}
+			name = append(name, toLowerASCII(b))
+		}
+
+		if b == '>' {
+			attrs[string(name)] = ""
+			return attrs, nil
+		}
+		if b != '=' {
+			attrs[string(name)] = ""
+			continue
+		}
+
+		value, end, err := s.readAttrValue()
+		if err != nil {
+			return attrs, err
+		}
+		attrs[string(name)] = html.UnescapeString(value)
+		if end {
+			return attrs, nil
+		}
+	}
+}
+
+// readAttrValue reads a quoted or bare value; end reports whether it
+// also consumed the closing '>'.
+func (s *pageScanner) readAttrValue() (value string, end bool, err error) {
+	b, err := s.readByte()
+	if err != nil {
+		return "", false, err
+	}
+
+	if b == '"' || b == '\'' {
+		v, err := s.readUntil(b, true)
+		return string(v), false, err
+	}
+
+	v := []byte{b}
+	for {
+		b, err := s.readByte()
+		if err != nil {
+			return string(v), false, err
+		}
+		switch b {
+		case '>':
+			return string(v), true, nil
+		case ' ', '\t', '\n', '\r':
+			return string(v), false, nil
+		}
+		v = append(v, b)
+	}
+}
+
+var (
+	scriptEnd = []byte("</script")
+
+	// dataScriptPrefixes mark scripts worth keeping; they appear near the
+	// start of the script, so others can be skipped without buffering.
+	dataScriptPrefixes = [][]byte{sharedDataMarker, []byte("__additionalDataLoaded"), additionalDataMarker}
+)
+
+const scriptSniffBytes = 256
+
+// readScript returns the body of a data script, or nil for any other
+// script, consuming the end tag either way. Scripts are sniffed as soon as
+// scriptSniffBytes have been read, so other scripts are never buffered
+// whole, even when they have no '<' in them.
+func (s *pageScanner) readScript() ([]byte, error) {
+	var body []byte
+	keep, sniffed := true, false
+
+	for {
+		b, err := s.r.ReadSlice('<')
+		s.read += int64(len(b))
+		if err == nil {
+			b = b[:len(b)-1]
+		}
+
+		if keep {
+			body = append(body, b...)
+		}
+		switch {
+		case err == bufio.ErrBufferFull:
+			// no '<' in a whole buffer; keep going, but sniff first
+		case err != nil:
+			return body, err
+		default:
+			peek, _ := s.r.Peek(len(scriptEnd) - 1)
+			if bytes.EqualFold(peek, scriptEnd[1:]) {
+				return body, s.skipTag()
+			}
+			if keep {
+				body = append(body, '<')
+			}
+		}
+
+		if keep && !sniffed && len(body) >= scriptSniffBytes {
+			sniffed = true
+			if !isDataScript(body) {
+				keep, body = false, nil
+			}
+		}
+	}
+}
+
+func isDataScript(body []byte) bool {
+	if len(body) > scriptSniffBytes {
+		body = body[:scriptSniffBytes]
+	}
+	for _, p := range dataScriptPrefixes {
+		if bytes.Contains(body, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func isASCIILetter(b byte) bool {
+	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+func toLowerASCII(b byte) byte {
+	if b >= 'A' && b <= 'Z' {
+		return b + 'a' - 'A'
+	}
+	return b
+}
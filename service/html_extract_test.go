@@ -0,0 +1,186 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/yemble/slack-instagram/replay"
+)
+
+// readPageFixture returns the last response body in a fixture cassette.
+func readPageFixture(t testing.TB, name string) []byte {
+	c, err := replay.Load(filepath.Join("testdata", "fixtures", name+".json"))
+	if err != nil {
+		t.Fatalf("reading fixture: %s", err)
+	}
+	return []byte(c.Interactions[len(c.Interactions)-1].Body)
+}
+
+func TestScanPage(t *testing.T) {
+	data := readPageFixture(t, "synthetic_carousel")
+
+	page, err := scanPage(bytes.NewReader(data), maxInstaPageBytes)
+	if err != nil {
+		t.Fatalf("scan: %s", err)
+	}
+
+	if !strings.HasPrefix(page.Title, "Harbour Photos on Instagram: “Morning") {
+		t.Errorf("unexpected title %q", page.Title)
+	}
+	if page.Meta["og:image"] != "https://scontent.cdninstagram.com/v/t51.2885-15/e35/101_n.jpg?_nc_ht=scontent.cdninstagram.com&oh=1" {
+		t.Errorf("unexpected og:image %q", page.Meta["og:image"])
+	}
+	if page.SharedData == nil || page.AdditionalData == nil {
+		t.Errorf("expected both data scripts")
+	}
+
+	meta, err := extractMeta(page, "https://www.instagram.com/p/CA1lPepDJXO/", 1)
+	if err != nil {
+		t.Fatalf("extract: %s", err)
+	}
+	if meta.Strategy != "additional_data" || meta.Username != "harbour.photos" || meta.PartCount != 3 || !meta.ImageIsVideo {
+		t.Errorf("unexpected meta %#v", meta)
+	}
+
+	// stops after the data script, before a large bundle
+	bundle := "<script>" + strings.Repeat("var a = 1;\n", 32<<10) + "</script>"
+	padded := append(append([]byte{}, data...), bundle...)
+	r := &countingReader{r: bytes.NewReader(padded)}
+	if _, err := scanPage(r, maxInstaPageBytes); err != nil {
+		t.Fatalf("scan: %s", err)
+	}
+	if r.n >= len(padded)/2 {
+		t.Errorf("expected to stop early, read %d of %d bytes", r.n, len(padded))
+	}
+
+	// gives up when the data is beyond the limit
+	padded = append([]byte("<html><head><title>x</title></head><body>"+bundle), data...)
+	page, err = scanPage(bytes.NewReader(padded), 64<<10)
+	if err != nil || !page.Truncated || page.AdditionalData != nil {
+		t.Errorf("expected truncated scan without post data, got %v", err)
+	}
+}
+
+func TestReadScriptSkipsWithoutBuffering(t *testing.T) {
+	// a large script with no '<' in it
+	src := strings.Repeat("var a = 1;\n", 100<<10) + "</script><title>after</title>"
+
+	var before, after runtime.MemStats
+	s := &pageScanner{r: bufio.NewReaderSize(strings.NewReader(src), 32<<10)}
+	runtime.ReadMemStats(&before)
+	body, err := s.readScript()
+	runtime.ReadMemStats(&after)
+
+	if err != nil || body != nil {
+		t.Fatalf("expected the script to be skipped, got %d bytes and %v", len(body), err)
+	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 64<<10 {
+		t.Errorf("expected the script not to be buffered, allocated %d bytes", alloc)
+	}
+
+	page := &pageData{Meta: make(map[string]string)}
+	if err := s.scan(page); (err != nil && err != io.EOF) || page.Title != "after" {
+		t.Errorf("expected scanning to carry on after the script, got %q and %v", page.Title, err)
+	}
+}
+
+func TestScanPageMarkup(t *testing.T) {
+	page := mustScanPage(t, `<!-- <title>no</title> --><TITLE>a &amp; b</TITLE>`+
+		`<meta name=description content=bare><meta content='single' property='og:url'/>`+
+		`<script>if (a<b) {}</script ><p>x < y</p>`)
+
+	if page.Title != "a & b" {
+		t.Errorf("unexpected title %q", page.Title)
+	}
+	if page.Meta["description"] != "bare" || page.Meta["og:url"] != "single" {
+		t.Errorf("unexpected meta %v", page.Meta)
+	}
+}
+
+type countingReader struct {
+	r *bytes.Reader
+	n int
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += n
+	return n, err
+}
+
+// legacyExtract is the extraction used before scanPage: read everything,
+// then run regexes compiled on every call.
+func legacyExtract(r *bytes.Reader) (*InstaMeta, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	title := regexp.MustCompile(`(?s)<title>(.+?)</title>`).FindSubmatch(data)
+	if title == nil {
+		return nil, fmt.Errorf("no title")
+	}
+
+	match := regexp.MustCompile(`(?s)({"graphql":{"shortcode_media":.+?)\);?</script>`).FindSubmatch(data)
+	if match == nil {
+		return nil, fmt.Errorf("json not found")
+	}
+
+	ad := &InstagramAdditionalData{}
+	if err := json.Unmarshal(match[1], ad); err != nil {
+		return nil, err
+	}
+
+	meta := shortcodeMediaMeta(ad.GraphQL.ShortcodeMedia, 0)
+	meta.Title = strings.TrimSpace(string(title[1]))
+	return meta, nil
+}
+
+// BenchmarkExtract compares the old regexp extraction with the streaming
+// scanner over every fixture cassette.
+func BenchmarkExtract(b *testing.B) {
+	names, err := filepath.Glob(filepath.Join("testdata", "fixtures", "*.json"))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, path := range names {
+		name := strings.TrimSuffix(filepath.Base(path), ".json")
+		if name == "cases" {
+			continue
+		}
+		data := readPageFixture(b, name)
+
+		b.Run(name+"/legacy", func(b *testing.B) {
+			if _, err := legacyExtract(bytes.NewReader(data)); err != nil {
+				b.Skipf("legacy extraction doesn't handle this page: %s", err)
+			}
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				legacyExtract(bytes.NewReader(data))
+			}
+		})
+
+		b.Run(name+"/streaming", func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				page, err := scanPage(bytes.NewReader(data), maxInstaPageBytes)
+				if err != nil {
+					b.Fatal(err)
+				}
+				extractMeta(page, "", 0)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/slack-go/slack"
+)
+
+// Inspection is what the bot makes of a post, for tools that check the
+// extraction pipeline. Meta is what fetchInsta would return; Strategies
+// has every strategy's result, including those after the one that won.
+type Inspection struct {
+	URL        string            `json:"url"`
+	Meta       *InstaMeta        `json:"meta,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Strategies []*StrategyResult `json:"strategies,omitempty"`
+	Truncated  bool              `json:"truncated,omitempty"`
+	// ReadTime covers fetching or reading the page and scanning it,
+	// ExtractTime running the strategies over it.
+	ReadTime    Duration `json:"read_time"`
+	ExtractTime Duration `json:"extract_time"`
+}
+
+// StrategyResult is how one extraction strategy fared on a page.
+type StrategyResult struct {
+	Name  string   `json:"name"`
+	Error string   `json:"error,omitempty"`
+	Took  Duration `json:"took"`
+}
+
+// RenderedPost is what would be posted to slack for a post.
+type RenderedPost struct {
+	Slash  *slack.Msg    `json:"slash_command"`
+	Unfurl []slack.Block `json:"unfurl"`
+}
+
+// InspectURL fetches a post the way the handler does, through its
+// sessions, rate limits and transport, and inspects the page. It leaves
+// the breaker, session health and stored cookies as they were.
+func InspectURL(ctx context.Context, lh lambda.Handler, instaURL string, instaOffset int) *Inspection {
+	in := &Inspection{URL: instaURL}
+
+	h, ok := lh.(*handler)
+	if !ok {
+		in.Error = "inspecting needs a handler from NewHandler"
+		return in
+	}
+
+	start := time.Now()
+	page, err := h.peekInstaPage(ctx, instaURL)
+	in.ReadTime.Duration = time.Since(start)
+	if err != nil {
+		in.Error = err.Error()
+		return in
+	}
+
+	in.inspectPage(page, instaOffset)
+	return in
+}
+
+// InspectHTML inspects a saved post page.
+func InspectHTML(r io.Reader, instaURL string, instaOffset int) *Inspection {
+	in := &Inspection{URL: instaURL}
+
+	start := time.Now()
+	page, err := scanPage(r, maxInstaPageBytes)
+	in.ReadTime.Duration = time.Since(start)
+	if err != nil {
+		in.Error = err.Error()
+		return in
+	}
+
+	in.inspectPage(page, instaOffset)
+	return in
+}
+
+func (in *Inspection) inspectPage(page *pageData, instaOffset int) {
+	in.Truncated = page.Truncated
+
+	for _, s := range extractStrategies {
+		start := time.Now()
+		_, err := s.extract(page, instaOffset)
+
+		res := &StrategyResult{Name: s.name, Took: Duration{time.Since(start)}}
+		if err != nil {
+			res.Error = err.Error()
+		}
+		in.Strategies = append(in.Strategies, res)
+	}
+
+	start := time.Now()
+	meta, err := extractMeta(page, in.URL, instaOffset)
+	in.ExtractTime.Duration = time.Since(start)
+	if err != nil {
+		in.Error = err.Error()
+		return
+	}
+	in.Meta = meta
+}
+
+// RenderPost renders meta with the team's render config, or the
+// config-wide one when team is nil.
+func RenderPost(cfg *Config, team *TeamInfo, userID string, meta *InstaMeta) *RenderedPost {
+	r := cfg.rendererForTeam(team)
+	return &RenderedPost{
+		Slash:  r.slashMessage(userID, meta),
+		Unfurl: r.unfurlBlocks(meta),
+	}
+}
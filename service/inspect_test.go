@@ -0,0 +1,90 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yemble/slack-instagram/replay"
+)
+
+func TestInspect(t *testing.T) {
+	cassette, err := replay.Load(filepath.Join("testdata", "fixtures", "synthetic_carousel.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(&Config{CookieString: "sessionid=test"}, nil, newMemoryStore(), WithTransport(replay.NewPlayer(cassette)))
+	instaURL := cassette.Interactions[0].URL
+
+	fetched := InspectURL(context.Background(), h, instaURL, 1)
+	if fetched.Error != "" || fetched.Meta == nil {
+		t.Fatalf("unexpected error %q", fetched.Error)
+	}
+
+	saved := InspectHTML(strings.NewReader(cassette.Interactions[len(cassette.Interactions)-1].Body), instaURL, 1)
+
+	for _, in := range []*Inspection{fetched, saved} {
+		if in.Meta.Strategy != "additional_data" || in.Meta.PartIndex != 1 || !in.Meta.ImageIsVideo {
+			t.Errorf("unexpected meta %#v", in.Meta)
+		}
+
+		// every strategy is tried, not just up to the first match
+		if len(in.Strategies) != len(extractStrategies) || in.Strategies[0].Error != "" || in.Strategies[1].Error == "" || in.Strategies[2].Error != "" {
+			t.Errorf("unexpected strategy results %+v", in.Strategies)
+		}
+	}
+
+	post := RenderPost(&Config{}, nil, "U1", fetched.Meta)
+	if !strings.HasPrefix(post.Slash.Text, "<@U1> shared") || len(post.Unfurl) == 0 {
+		t.Errorf("unexpected rendering %#v", post)
+	}
+}
+
+func TestInspectLeavesNoTrace(t *testing.T) {
+	ctx := context.Background()
+
+	status := http.StatusTooManyRequests
+	rt := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if status == http.StatusOK {
+			// as if redirected to the login page
+			req.URL.Path = "/accounts/login/"
+		}
+		return &http.Response{StatusCode: status, Header: http.Header{"Set-Cookie": {"sessionid=new"}}, Body: ioutil.NopCloser(strings.NewReader("<html></html>")), Request: req}, nil
+	})
+
+	cfg := &Config{
+		CookieString:    "sessionid=test",
+		InstagramLimits: &InstagramLimitConfig{BreakerThreshold: 1},
+	}
+	lh := NewHandler(cfg, nil, newMemoryStore(), WithTransport(rt))
+	h := lh.(*handler)
+
+	if in := InspectURL(ctx, lh, "https://www.instagram.com/p/x/", 0); in.Error == "" {
+		t.Fatalf("expected an error for a 429")
+	}
+	if _, err := h.store.Get(ctx, instaFailuresKey); err != errNotFound {
+		t.Errorf("expected no failures to be counted, got %v", err)
+	}
+	if err := h.checkBreaker(ctx); err != nil {
+		t.Errorf("expected the breaker to stay closed, got %s", err)
+	}
+
+	status = http.StatusOK
+	if in := InspectURL(ctx, lh, "https://www.instagram.com/p/x/", 0); in.Error != errLoginWall.Error() {
+		t.Fatalf("expected the login wall, got %q", in.Error)
+	}
+	if h.sessionNext != 0 {
+		t.Errorf("expected the round robin not to move, got %d", h.sessionNext)
+	}
+	for _, sc := range cfg.sessions() {
+		if !h.sessionHealthy(ctx, sc.Name) {
+			t.Errorf("expected session %s not to be marked", sc.Name)
+		}
+		if s := h.loadSession(ctx, sc); s.cookies != sc.Cookies {
+			t.Errorf("expected session %s cookies not to be saved, got %q", sc.Name, s.cookies)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultInstaPerMinute        = 60
+	defaultInstaBurst            = 10
+	defaultInstaSessionPerMinute = 20
+	defaultInstaSessionBurst     = 5
+	defaultBreakerThreshold      = 5
+	defaultBreakerCooldown       = 5 * time.Minute
+
+	// breakerWindow is how long failures count towards opening the breaker.
+	breakerWindow = 5 * time.Minute
+
+	instaBreakerKey        = "instagram/breaker"
+	instaBreakerAlertedKey = "instagram/breaker_alerted"
+	instaFailuresKey       = "instagram/failures"
+)
+
+// InstagramLimitConfig throttles fetches from instagram. Rates are
+// requests per minute, for the whole process and for each session.
+type InstagramLimitConfig struct {
+	PerMinute        float64 `json:"per_minute,omitempty"`
+	Burst            int     `json:"burst,omitempty"`
+	SessionPerMinute float64 `json:"session_per_minute,omitempty"`
+	SessionBurst     int     `json:"session_burst,omitempty"`
+
+	// BreakerThreshold failures within five minutes stop fetches for
+	// BreakerCooldown.
+	BreakerThreshold int      `json:"breaker_threshold,omitempty"`
+	BreakerCooldown  Duration `json:"breaker_cooldown,omitempty"`
+}
+
+// circuitOpenError is returned without trying instagram while it's
+// rejecting us. It isn't permanent, so queued requests are retried once
+// the breaker closes.
+type circuitOpenError struct {
+	until time.Time
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("instagram circuit breaker open until %s", e.until.Format(time.RFC3339))
+}
+
+// instaClient is shared by all instagram fetches so they can be
+// throttled together.
+type instaClient struct {
+	global *tokenBucket
+
+	sessionPerMinute float64
+	sessionBurst     int
+
+	mu       sync.Mutex
+	sessions map[string]*tokenBucket
+	// failing is set while there are failures recorded in the store
+	failing bool
+}
+
+func newInstaClient(cfg *InstagramLimitConfig) *instaClient {
+	c := &InstagramLimitConfig{}
+	if cfg != nil {
+		*c = *cfg
+	}
+	if c.PerMinute <= 0 {
+		c.PerMinute = defaultInstaPerMinute
+	}
+	if c.Burst <= 0 {
+		c.Burst = defaultInstaBurst
+	}
+	if c.SessionPerMinute <= 0 {
+		c.SessionPerMinute = defaultInstaSessionPerMinute
+	}
+	if c.SessionBurst <= 0 {
+		c.SessionBurst = defaultInstaSessionBurst
+	}
+
+	return &instaClient{
+		global:           newTokenBucket(c.PerMinute, c.Burst),
+		sessionPerMinute: c.SessionPerMinute,
+		sessionBurst:     c.SessionBurst,
+		sessions:         make(map[string]*tokenBucket),
+	}
+}
+
+func (c *instaClient) sessionBucket(name string) *tokenBucket {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, ok := c.sessions[name]
+	if !ok {
+		b = newTokenBucket(c.sessionPerMinute, c.sessionBurst)
+		c.sessions[name] = b
+	}
+	return b
+}
+
+// wait takes a token from the global and the session's bucket.
+func (c *instaClient) wait(ctx context.Context, sessionName string) error {
+	if err := c.global.wait(ctx); err != nil {
+		return fmt.Errorf("waiting for instagram rate limit: %w", err)
+	}
+	if err := c.sessionBucket(sessionName).wait(ctx); err != nil {
+		return fmt.Errorf("waiting for session %s rate limit: %w", sessionName, err)
+	}
+	return nil
+}
+
+func (h *handler) instagram() *instaClient {
+	h.instaOnce.Do(func() {
+		h.insta = newInstaClient(h.config.InstagramLimits)
+	})
+	return h.insta
+}
+
+func (h *handler) breakerThreshold() int64 {
+	if l := h.config.InstagramLimits; l != nil && l.BreakerThreshold > 0 {
+		return int64(l.BreakerThreshold)
+	}
+	return defaultBreakerThreshold
+}
+
+func (h *handler) breakerCooldown() time.Duration {
+	if l := h.config.InstagramLimits; l != nil && l.BreakerCooldown.Duration > 0 {
+		return l.BreakerCooldown.Duration
+	}
+	return defaultBreakerCooldown
+}
+
+// checkBreaker fails fast while the breaker is open. The breaker lives
+// in the store so every instance backs off together.
+func (h *handler) checkBreaker(ctx context.Context) error {
+	data, err := h.store.Get(ctx, instaBreakerKey)
+	if err != nil {
+		return nil
+	}
+
+	until, _ := strconv.ParseInt(string(data), 10, 64)
+	if time.Now().Unix() >= until {
+		return nil
+	}
+
+	return &circuitOpenError{until: time.Unix(until, 0)}
+}
+
+func (h *handler) openBreaker(ctx context.Context, d time.Duration) {
+	until := time.Now().Add(d)
+	log.Printf("Backing off instagram until %s", until.Format(time.RFC3339))
+
+	if err := h.store.Put(ctx, instaBreakerKey, []byte(strconv.FormatInt(until.Unix(), 10)), d); err != nil {
+		log.Printf("Error opening instagram breaker: %s", err)
+	}
+}
+
+// recordInstaFailure counts a rejection from instagram, backing off for
+// retryAfter if it told us to and opening the breaker once failures pile
+// up.
+func (h *handler) recordInstaFailure(ctx context.Context, retryAfter time.Duration) {
+	c := h.instagram()
+	c.mu.Lock()
+	c.failing = true
+	c.mu.Unlock()
+
+	if retryAfter > 0 {
+		h.openBreaker(ctx, retryAfter)
+	}
+
+	n, err := h.store.Add(ctx, instaFailuresKey, 1, breakerWindow)
+	if err != nil {
+		log.Printf("Error counting instagram failures: %s", err)
+		return
+	}
+
+	if n < h.breakerThreshold() {
+		return
+	}
+
+	// Failures keep counting through the window, so one straight after
+	// a cooldown opens the breaker again. Only the first opening alerts.
+	h.openBreaker(ctx, h.breakerCooldown())
+
+	alerted, err := h.store.Add(ctx, instaBreakerAlertedKey, 1, h.breakerCooldown()+breakerWindow)
+	if err != nil {
+		log.Printf("Error checking for instagram breaker alert: %s", err)
+	}
+	if alerted <= 1 {
+		if err := h.alertAdmin(ctx, fmt.Sprintf(":no_entry: Instagram rejected %d fetches within %s, pausing fetches for %s", n, breakerWindow, h.breakerCooldown())); err != nil {
+			log.Printf("Error alerting on instagram breaker: %s", err)
+		}
+	}
+}
+
+func (h *handler) recordInstaSuccess(ctx context.Context) {
+	c := h.instagram()
+	c.mu.Lock()
+	failing := c.failing
+	c.failing = false
+	c.mu.Unlock()
+
+	if failing {
+		if err := h.store.Delete(ctx, instaFailuresKey); err != nil {
+			log.Printf("Error resetting instagram failures: %s", err)
+		}
+		h.store.Delete(ctx, instaBreakerAlertedKey)
+	}
+}
+
+// retryAfter parses a Retry-After header given in seconds or as a date.
+func retryAfter(resp *http.Response) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+
+	return 0
+}
+
+// friendlyError is what to tell a user whose request failed with err.
+func friendlyError(err error) string {
+	var open *circuitOpenError
+	if errors.As(err, &open) {
+		mins := int(time.Until(open.until).Minutes()) + 1
+		return fmt.Sprintf("Instagram is turning us away right now, please try again in %d minute(s).", mins)
+	}
+
+	return "Error fetching data from instagram"
+}
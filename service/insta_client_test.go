@@ -0,0 +1,78 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(60, 2)
+	now := b.last
+
+	if b.take(now) != 0 || b.take(now) != 0 {
+		t.Fatalf("expected burst of 2")
+	}
+	if d := b.take(now); d <= 0 || d > time.Second {
+		t.Errorf("expected to wait up to a second, got %s", d)
+	}
+	if d := b.take(now.Add(time.Second)); d != 0 {
+		t.Errorf("expected a token after a second, got wait %s", d)
+	}
+}
+
+func TestInstagramBreaker(t *testing.T) {
+	ctx := context.Background()
+
+	hits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	h := &handler{
+		config: &Config{
+			CookieString:    "sessionid=x",
+			InstagramLimits: &InstagramLimitConfig{PerMinute: 6000, Burst: 10, SessionPerMinute: 6000, SessionBurst: 10, BreakerThreshold: 3},
+		},
+		store: newMemoryStore(),
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := h.fetchInstaPage(ctx, srv.URL); err == nil || isPermanent(err) {
+			t.Fatalf("expected retryable error, got %v", err)
+		}
+	}
+
+	_, err := h.fetchInstaPage(ctx, srv.URL)
+	var open *circuitOpenError
+	if !errors.As(err, &open) || isPermanent(err) || hits != 3 {
+		t.Fatalf("expected breaker to fail fast and be retried later, got %v after %d hits", err, hits)
+	}
+	if msg := friendlyError(err); !strings.Contains(msg, "try again in 5 minute") {
+		t.Errorf("unexpected friendly message %q", msg)
+	}
+
+	// cooldown over, but instagram is still failing
+	h.store.Delete(ctx, instaBreakerKey)
+	h.fetchInstaPage(ctx, srv.URL)
+	if _, err := h.fetchInstaPage(ctx, srv.URL); !errors.As(err, &open) || hits != 4 {
+		t.Fatalf("expected breaker to open again, got %v after %d hits", err, hits)
+	}
+
+	if n, _ := h.store.Add(ctx, instaBreakerAlertedKey, 0, time.Minute); n != 2 {
+		t.Errorf("expected the second opening not to alert, got %d openings", n)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	resp := &http.Response{Header: http.Header{"Retry-After": {"120"}}}
+	if d := retryAfter(resp); d != 2*time.Minute {
+		t.Errorf("expected 2m, got %s", d)
+	}
+}
@@ -1,15 +1,16 @@
 package service
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"regexp"
 	"runtime"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 type InstaMeta struct {
@@ -20,71 +21,146 @@ type InstaMeta struct {
 	ImageURL     string
 	ImageIsVideo bool
 	PartCount    int
+	PartIndex    int
+	Caption      string
+	TakenAt      time.Time
+	// Strategy names the extraction strategy that produced this.
+	Strategy string
 }
 
-func getOGMeta(data []byte) (*InstaMeta, error) {
-	metaPattern := regexp.MustCompile(`<meta property="(.+?)" content="(.+?)" />`)
-
-	matches := metaPattern.FindAllSubmatch(data, -1)
-	if matches == nil {
-		log.Printf("Failed to match metadata in: %s", string(data)[0:300])
-		return nil, fmt.Errorf("Error parsing instagram response, no metadata found")
+func getOGMeta(page *pageData) (*InstaMeta, error) {
+	if page.Meta["og:image"] == "" {
+		return nil, fmt.Errorf("No image url in og meta")
 	}
 
-	meta := &InstaMeta{}
+	return &InstaMeta{
+		Title:    page.Meta["og:title"],
+		URL:      page.Meta["og:url"],
+		ImageURL: page.Meta["og:image"],
+	}, nil
+}
 
-	for _, m := range matches {
-		switch string(m[1]) {
-		case "og:title":
-			meta.Title = string(m[2])
-		case "og:url":
-			meta.URL = string(m[2])
-		case "og:image":
-			meta.ImageURL = string(m[2])
-		}
-	}
+// extractStrategy is one way of pulling post metadata out of a page.
+// Instagram has moved its embedded data around over time, so strategies
+// are tried in order until one works.
+type extractStrategy struct {
+	name    string
+	extract func(page *pageData, instaOffset int) (*InstaMeta, error)
+}
 
-	if meta.ImageURL == "" {
-		return nil, fmt.Errorf("No image url in og meta")
-	}
+var extractStrategies = []*extractStrategy{
+	{name: "additional_data", extract: extractAdditionalData},
+	{name: "shared_data", extract: extractSharedData},
+	{name: "og_meta", extract: extractOGMeta},
+}
 
-	return meta, nil
+// extractError lists why each strategy failed.
+type extractError struct {
+	Failures map[string]error
 }
 
-func getMetaFromResponse(resp *http.Response, fetchedURL string, instaOffset int) (*InstaMeta, error) {
+func (e *extractError) Error() string {
+	parts := make([]string, 0, len(extractStrategies))
+	for _, s := range extractStrategies {
+		if err, ok := e.Failures[s.name]; ok {
+			parts = append(parts, fmt.Sprintf("%s: %s", s.name, err))
+		}
+	}
+	return "no extraction strategy matched (" + strings.Join(parts, "; ") + ")"
+}
+
+// readInstaResponse scans a response body for the parts of the page the
+// extraction strategies use, failing with errLoginWall if it's the login
+// page.
+func readInstaResponse(resp *http.Response) (*pageData, error) {
 	if resp.StatusCode >= 300 {
-		return nil, fmt.Errorf("Unexpected status: %d", resp.StatusCode)
+		return nil, statusError("instagram", resp.StatusCode)
 	}
 
-	data, err := ioutil.ReadAll(resp.Body)
+	page, err := scanPage(resp.Body, maxInstaPageBytes)
 	if err != nil {
 		return nil, fmt.Errorf("Error reading data: %w", err)
 	}
+	if page.Truncated {
+		log.Printf("Stopped reading %s after %d bytes", resp.Request.URL, maxInstaPageBytes)
+	}
 
-	/*m, err := getOGMeta(data)
-	if err == nil {
-		return m, nil
-	}*/
+	if isLoginWall(resp, page) {
+		return nil, errLoginWall
+	}
 
-	meta := &InstaMeta{}
+	return page, nil
+}
 
-	title, _ := getDocTitle(data)
-	titleLines := strings.Split(title, "\n")
-	meta.Title = titleLines[0]
+// extractMeta runs the extraction strategies over a fetched page and
+// returns the first match, with Strategy set to the one that worked.
+func extractMeta(page *pageData, fetchedURL string, instaOffset int) (*InstaMeta, error) {
+	failures := make(map[string]error)
 
-	meta.URL = fetchedURL
+	for _, s := range extractStrategies {
+		meta, err := s.extract(page, instaOffset)
+		if err != nil {
+			failures[s.name] = err
+			continue
+		}
 
-	// get json from body, parse and extract data
+		meta.Strategy = s.name
+		if meta.URL == "" {
+			meta.URL = fetchedURL
+		}
+		if meta.Title == "" {
+			meta.Title = strings.Split(page.Title, "\n")[0]
+		}
+
+		return meta, nil
+	}
 
-	ad, err := parseAdditionalData(data)
+	return nil, permanent(&extractError{Failures: failures})
+}
+
+func extractAdditionalData(page *pageData, instaOffset int) (*InstaMeta, error) {
+	ad, err := decodeAdditionalData(page.AdditionalData)
 	if err != nil {
-		return meta, fmt.Errorf("Error parsing instagram response, no metadata or additional data")
+		return nil, err
 	}
+	if ad.GraphQL == nil || ad.GraphQL.ShortcodeMedia == nil {
+		return nil, fmt.Errorf("no shortcode_media")
+	}
+
+	return shortcodeMediaMeta(ad.GraphQL.ShortcodeMedia, instaOffset), nil
+}
+
+func extractSharedData(page *pageData, instaOffset int) (*InstaMeta, error) {
+	sd, err := decodeSharedData(page.SharedData)
+	if err != nil {
+		return nil, err
+	}
+	if len(sd.EntryData.PostPage) == 0 || sd.EntryData.PostPage[0].GraphQL == nil || sd.EntryData.PostPage[0].GraphQL.ShortcodeMedia == nil {
+		return nil, fmt.Errorf("no shortcode_media")
+	}
+
+	return shortcodeMediaMeta(sd.EntryData.PostPage[0].GraphQL.ShortcodeMedia, instaOffset), nil
+}
+
+func extractOGMeta(page *pageData, instaOffset int) (*InstaMeta, error) {
+	return getOGMeta(page)
+}
+
+func shortcodeMediaMeta(scm *InstagramShortcodeMedia, instaOffset int) *InstaMeta {
+	meta := &InstaMeta{}
 
-	scm := ad.GraphQL.ShortcodeMedia
+	if scm.Owner != nil {
+		meta.Username = scm.Owner.Username
+		meta.UserPicURL = scm.Owner.ProfilePicURL
+	}
 
-	meta.Username = scm.Owner.Username
-	meta.UserPicURL = scm.Owner.ProfilePicURL
+	if scm.EdgeMediaToCaption != nil && len(scm.EdgeMediaToCaption.Edges) > 0 && scm.EdgeMediaToCaption.Edges[0].Node != nil {
+		meta.Caption = scm.EdgeMediaToCaption.Edges[0].Node.Text
+	}
+
+	if scm.TakenAtTimestamp > 0 {
+		meta.TakenAt = time.Unix(scm.TakenAtTimestamp, 0).UTC()
+	}
 
 	if scm.EdgeSideCarToChildren == nil {
 		meta.PartCount = 1
@@ -99,63 +175,178 @@ func getMetaFromResponse(resp *http.Response, fetchedURL string, instaOffset int
 		node := scm.EdgeSideCarToChildren.Edges[instaOffset].Node
 		meta.ImageURL = node.DisplayURL
 		meta.ImageIsVideo = node.IsVideo
+		meta.PartIndex = instaOffset
+	}
+
+	return meta
+}
+
+// decodeAdditionalData decodes the graphql blob in a
+// window.__additionalDataLoaded script.
+func decodeAdditionalData(script []byte) (*InstagramAdditionalData, error) {
+	i := bytes.Index(script, additionalDataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("json not found")
+	}
+
+	ad := &InstagramAdditionalData{}
+	if err := json.NewDecoder(bytes.NewReader(script[i:])).Decode(ad); err != nil {
+		return nil, err
+	}
+
+	return ad, nil
+}
+
+// decodeSharedData decodes the object assigned to window._sharedData.
+func decodeSharedData(script []byte) (*InstagramSharedData, error) {
+	i := bytes.Index(script, sharedDataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("json not found")
+	}
+
+	j := bytes.IndexByte(script[i:], '=')
+	if j < 0 {
+		return nil, fmt.Errorf("json not found")
+	}
+
+	sd := &InstagramSharedData{}
+	if err := json.NewDecoder(bytes.NewReader(script[i+j+1:])).Decode(sd); err != nil {
+		return nil, err
 	}
 
+	return sd, nil
+}
+
+func (h *handler) fetchInsta(ctx context.Context, instaURL string, instaOffset int) (meta *InstaMeta, err error) {
+	start := time.Now()
+	defer func() {
+		h.metrics.observe(metricInstaFetch, time.Since(start).Seconds(), instaOutcome(ctx, err))
+	}()
+
+	page, err := h.fetchInstaPage(ctx, instaURL)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err = extractMeta(page, instaURL, instaOffset)
+	if err != nil {
+		h.metrics.observe(metricExtractStrategy, 1, "none")
+		return nil, err
+	}
+	h.metrics.observe(metricExtractStrategy, 1, meta.Strategy)
+
+	log.Printf("Parsed %s using %s", instaURL, meta.Strategy)
+
 	return meta, nil
 }
 
-func parseAdditionalData(data []byte) (*InstagramAdditionalData, error) {
-	p := regexp.MustCompile(`(?s)({"graphql":{"shortcode_media":.+?)\);?</script>`)
+// fetchInstaPage fetches and scans a post page, moving on
+// through the session pool when a session hits the login wall.
+func (h *handler) fetchInstaPage(ctx context.Context, instaURL string) (*pageData, error) {
+	if err := h.checkBreaker(ctx); err != nil {
+		return nil, err
+	}
+
+	var lastErr error
 
-	if match := p.FindSubmatch(data); match != nil {
-		ad := &InstagramAdditionalData{}
-		if err := json.Unmarshal(match[1], ad); err != nil {
-			return nil, err
+	for _, s := range h.nextSessions(ctx) {
+		page, err := h.fetchInstaPageWith(ctx, instaURL, s)
+		if err == errLoginWall {
+			h.markSessionUnhealthy(ctx, s.name, err)
+			lastErr = err
+			continue
 		}
 
-		return ad, nil
+		return page, err
 	}
 
-	return nil, fmt.Errorf("json not found")
+	return nil, lastErr
 }
 
-func getDocTitle(data []byte) (string, error) {
-	p := regexp.MustCompile(`(?s)<title>(.+?)</title>`)
+func (h *handler) fetchInstaPageWith(ctx context.Context, instaURL string, s *session) (*pageData, error) {
+	resp, err := h.getInstaPage(ctx, instaURL, s)
+	if err != nil {
+		// only trouble reaching instagram counts towards the breaker
+		if ctx.Err() == nil && !isPermanent(err) {
+			h.recordInstaFailure(ctx, 0)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
 
-	if match := p.FindSubmatch(data); match != nil {
-		raw := string(match[1])
-		return strings.TrimSpace(raw), nil
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		h.recordInstaFailure(ctx, retryAfter(resp))
+	} else {
+		h.recordInstaSuccess(ctx)
 	}
 
-	return "", fmt.Errorf("not found")
+	h.updateSessionCookies(ctx, s, resp)
+
+	return readInstaResponse(resp)
 }
 
-func (h *handler) fetchInsta(ctx context.Context, instaURL string, instaOffset int) (*InstaMeta, error) {
-	client := &http.Client{
-		Timeout: externalTimeout,
+// peekInstaPage fetches a page like fetchInstaPage but leaves the bot's
+// state alone: failures don't count towards the breaker, sessions aren't
+// marked, refreshed cookies aren't saved and the round robin doesn't move
+// on. It's for tools that look at what the bot would see. Fetches still
+// wait their turn on the rate limits, so a tool sharing a process with
+// the bot can't push it past them.
+func (h *handler) peekInstaPage(ctx context.Context, instaURL string) (*pageData, error) {
+	if err := h.checkBreaker(ctx); err != nil {
+		return nil, err
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, instaURL, nil)
+	var lastErr error
+
+	for _, s := range h.sessionsInOrder(ctx, atomic.LoadUint32(&h.sessionNext)) {
+		page, err := h.peekInstaPageWith(ctx, instaURL, s)
+		if err == errLoginWall {
+			lastErr = err
+			continue
+		}
+
+		return page, err
+	}
+
+	return nil, lastErr
+}
+
+func (h *handler) peekInstaPageWith(ctx context.Context, instaURL string, s *session) (*pageData, error) {
+	resp, err := h.getInstaPage(ctx, instaURL, s)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("User-agent", "private instagram slack expander <zach@y3m.net>")
-	req.Header.Set("X-requested-with", runtime.Version())
-	req.Header.Set("Cookie", h.config.CookieString)
+	defer resp.Body.Close()
+
+	return readInstaResponse(resp)
+}
 
-	log.Printf("Fetching %s", instaURL)
+// getInstaPage requests a page with session s, within the rate limits.
+func (h *handler) getInstaPage(ctx context.Context, instaURL string, s *session) (*http.Response, error) {
+	clients, err := h.http()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := h.instagram().wait(ctx, s.name); err != nil {
+		return nil, err
+	}
 
-	resp, err := client.Do(req)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, instaURL, nil)
 	if err != nil {
 		return nil, err
 	}
+	req.Header.Set("X-requested-with", runtime.Version())
+	req.Header.Set("Cookie", s.cookies)
 
-	log.Printf("Request for %s done, parsing meta data..", instaURL)
+	log.Printf("Fetching %s with session %s", instaURL, s.name)
 
-	meta, err := getMetaFromResponse(resp, instaURL, instaOffset)
+	resp, err := clients.insta.Do(req)
 	if err != nil {
 		return nil, err
 	}
 
-	return meta, nil
+	log.Printf("Request for %s done, parsing meta data..", instaURL)
+
+	return resp, nil
 }
@@ -4,6 +4,13 @@ type InstagramAdditionalData struct {
 	GraphQL *InstagramGraphQL `json:"graphql"`
 }
 
+// InstagramSharedData is the window._sharedData blob on older post pages.
+type InstagramSharedData struct {
+	EntryData struct {
+		PostPage []*InstagramAdditionalData `json:"PostPage"`
+	} `json:"entry_data"`
+}
+
 type InstagramGraphQL struct {
 	ShortcodeMedia *InstagramShortcodeMedia `json:"shortcode_media"`
 }
@@ -12,9 +19,23 @@ type InstagramShortcodeMedia struct {
 	DisplayURL            string                `json:"display_url"`
 	IsVideo               bool                  `json:"is_video,omitempty"`
 	EdgeSideCarToChildren *InstagramEdgeSideCar `json:"edge_sidecar_to_children,omitempty"`
+	EdgeMediaToCaption    *InstagramEdgeCaption `json:"edge_media_to_caption,omitempty"`
+	TakenAtTimestamp      int64                 `json:"taken_at_timestamp,omitempty"`
 	Owner                 *InstagramOwner       `json:"owner"`
 }
 
+type InstagramEdgeCaption struct {
+	Edges []*InstagramCaptionEdge `json:"edges"`
+}
+
+type InstagramCaptionEdge struct {
+	Node *InstagramCaptionNode `json:"node"`
+}
+
+type InstagramCaptionNode struct {
+	Text string `json:"text"`
+}
+
 type InstagramEdgeSideCar struct {
 	Edges []*InstagramEdge `json:"edges"`
 }
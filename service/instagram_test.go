@@ -1,23 +1,19 @@
 package service
 
 import (
+	"strings"
 	"testing"
 )
 
 func TestTitle(t *testing.T) {
 	var (
-		snippet = []byte(`<head>
+		snippet = `<head>
 			<title>Hello
-more</title></head>`)
+more</title></head>`
 		expected = "Hello\nmore"
 	)
 
-	title, err := getDocTitle(snippet)
-	if err != nil {
-		t.Errorf("parse: %s", err)
-	}
-
-	if title != expected {
+	if title := mustScanPage(t, snippet).Title; title != expected {
 		t.Errorf("expected: %s actual: %s", expected, title)
 	}
 }
@@ -25,28 +21,27 @@ more</title></head>`)
 func TestAdditionalData(t *testing.T) {
 	t.Run("single video", func(t *testing.T) {
 		var (
-			snippet = []byte(`</script><script type="text/javascript">window.__additionalDataLoaded('/p/CA1lPepDJXO/',{"graphql":{"shortcode_media":
-				{"is_video":true,"display_url":"https://vurl"}}});</script><`)
+			snippet = `</script><script type="text/javascript">window.__additionalDataLoaded('/p/CA1lPepDJXO/',{"graphql":{"shortcode_media":
+				{"is_video":true,"display_url":"https://vurl"}}});</script><`
 			expectedDisplayURL = "https://vurl"
 		)
 
-		ad, err := parseAdditionalData(snippet)
+		meta, err := extractMeta(mustScanPage(t, snippet), "https://www.instagram.com/p/CA1lPepDJXO/", 0)
 		if err != nil {
-			t.Errorf("parse: %s", err)
+			t.Fatalf("extract: %s", err)
 		}
 
-		if !ad.GraphQL.ShortcodeMedia.IsVideo {
-			t.Errorf("not video")
+		if meta.Strategy != "additional_data" || !meta.ImageIsVideo {
+			t.Errorf("expected a video from additional data, got %#v", meta)
 		}
 
-		if ad.GraphQL.ShortcodeMedia.DisplayURL != expectedDisplayURL {
-			t.Errorf("display url expected: %s actual: %s", expectedDisplayURL, ad.GraphQL.ShortcodeMedia.DisplayURL)
+		if meta.ImageURL != expectedDisplayURL {
+			t.Errorf("display url expected: %s actual: %s", expectedDisplayURL, meta.ImageURL)
 		}
 	})
 
 	t.Run("multiple images", func(t *testing.T) {
-		var (
-			snippet = []byte(`</script><script type="text/javascript">window.__additionalDataLoaded('/p/CA1lPepDJXO/',{"graphql":{"shortcode_media":
+		snippet := `</script><script type="text/javascript">window.__additionalDataLoaded('/p/CA1lPepDJXO/',{"graphql":{"shortcode_media":
 				{"is_video":false,"display_url":"https://vurl",
 					"foo": "bar",
 					"edge_sidecar_to_children":{"edges":[
@@ -54,24 +49,78 @@ func TestAdditionalData(t *testing.T) {
 						{"node":{"display_url":"//2"}},
 						{"node":{"display_url":"//3"}}
 					]}
-				}}});</script><`)
-		)
+				}}});</script><`
 
-		ad, err := parseAdditionalData(snippet)
+		meta, err := extractMeta(mustScanPage(t, snippet), "https://www.instagram.com/p/CA1lPepDJXO/", 1)
 		if err != nil {
-			t.Errorf("parse: %s", err)
+			t.Fatalf("extract: %s", err)
 		}
 
-		if ad.GraphQL.ShortcodeMedia.IsVideo {
+		if meta.ImageIsVideo {
 			t.Errorf("is video")
 		}
 
-		if len(ad.GraphQL.ShortcodeMedia.EdgeSideCarToChildren.Edges) != 3 {
-			t.Errorf("expected 3 edges, got %d", len(ad.GraphQL.ShortcodeMedia.EdgeSideCarToChildren.Edges))
+		if meta.PartCount != 3 {
+			t.Errorf("expected 3 parts, got %d", meta.PartCount)
 		}
 
-		if ad.GraphQL.ShortcodeMedia.EdgeSideCarToChildren.Edges[1].Node.DisplayURL != "//2" {
-			t.Errorf("unexpected second display url: %s", ad.GraphQL.ShortcodeMedia.EdgeSideCarToChildren.Edges[1].Node.DisplayURL)
+		if meta.ImageURL != "//2" || meta.PartIndex != 1 {
+			t.Errorf("unexpected second display url: %s", meta.ImageURL)
 		}
 	})
 }
+
+func TestExtractStrategies(t *testing.T) {
+	cases := []struct {
+		name     string
+		page     string
+		strategy string
+		username string
+	}{
+		{
+			name:     "additional data",
+			page:     `<script>window.__additionalDataLoaded('/p/x/',{"graphql":{"shortcode_media":{"display_url":"https://img","owner":{"username":"alice"}}}});</script>`,
+			strategy: "additional_data",
+			username: "alice",
+		},
+		{
+			name:     "shared data",
+			page:     `<script type="text/javascript">window._sharedData = {"entry_data":{"PostPage":[{"graphql":{"shortcode_media":{"display_url":"https://img","owner":{"username":"bob"}}}}]}};</script>`,
+			strategy: "shared_data",
+			username: "bob",
+		},
+		{
+			name:     "og meta",
+			page:     `<head><meta property="og:title" content="A post" /><meta property="og:image" content="https://img" /></head>`,
+			strategy: "og_meta",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			meta, err := extractMeta(mustScanPage(t, c.page), "https://www.instagram.com/p/x/", 0)
+			if err != nil {
+				t.Fatalf("extract: %s", err)
+			}
+			if meta.Strategy != c.strategy || meta.Username != c.username || meta.ImageURL != "https://img" {
+				t.Errorf("unexpected meta %#v", meta)
+			}
+		})
+	}
+
+	_, err := extractMeta(mustScanPage(t, `<html>login</html>`), "https://www.instagram.com/p/x/", 0)
+	if err == nil || !isPermanent(err) {
+		t.Fatalf("expected permanent error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "shared_data: json not found") {
+		t.Errorf("expected per strategy failures in %q", err)
+	}
+}
+
+func mustScanPage(t testing.TB, s string) *pageData {
+	page, err := scanPage(strings.NewReader(s), maxInstaPageBytes)
+	if err != nil {
+		t.Fatalf("scan: %s", err)
+	}
+	return page
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const canarySnippetLen = 1500
+
+// CanaryConfig lists known posts the canary job checks extraction
+// against, to catch Instagram markup changes before users do.
+type CanaryConfig struct {
+	Posts []*CanaryPost `json:"posts"`
+}
+
+// CanaryPost is a post with known content. PartCount is checked when set.
+type CanaryPost struct {
+	URL       string `json:"url"`
+	PartCount int    `json:"part_count,omitempty"`
+}
+
+func init() {
+	registerJob(&job{
+		name:    "parser_canary",
+		every:   6 * time.Hour,
+		timeout: 2 * time.Minute,
+		enabled: func(cfg *Config) bool {
+			return cfg.Canary != nil && len(cfg.Canary.Posts) > 0
+		},
+		run: func(ctx context.Context, h *handler) error {
+			return h.runCanary(ctx)
+		},
+	})
+}
+
+func canaryStoreKey(postURL string) string {
+	return "canary/" + dedupID(postURL)
+}
+
+func (h *handler) runCanary(ctx context.Context) error {
+	failed := 0
+
+	for _, post := range h.config.Canary.Posts {
+		if err := h.checkCanaryPost(ctx, post); err != nil {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d canary posts failed", failed, len(h.config.Canary.Posts))
+	}
+	return nil
+}
+
+// checkCanaryPost alerts when a post starts failing and again when it
+// recovers, rather than on every run.
+func (h *handler) checkCanaryPost(ctx context.Context, post *CanaryPost) error {
+	page, err := h.fetchInstaPage(ctx, post.URL)
+	if err != nil {
+		// fetch problems aren't markup drift; cookie_check covers those
+		return err
+	}
+
+	problem := ""
+	meta, err := extractMeta(page, post.URL, 0)
+	if err != nil {
+		problem = err.Error()
+	} else if missing := validateCanaryMeta(post, meta); len(missing) > 0 {
+		problem = fmt.Sprintf("strategy %s matched but %s", meta.Strategy, strings.Join(missing, ", "))
+	}
+
+	key := canaryStoreKey(post.URL)
+	_, alerted := h.store.Get(ctx, key)
+
+	if problem == "" {
+		if alerted == nil {
+			h.store.Delete(ctx, key)
+			if err := h.alertAdmin(ctx, fmt.Sprintf(":white_check_mark: Extraction of %s works again (strategy %s)", post.URL, meta.Strategy)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if alerted == errNotFound {
+		// Record the failure first, so a store error can't mean an alert
+		// on every run; if the alert doesn't go out, forget it to try again.
+		if err := h.store.Put(ctx, key, []byte(problem), 0); err != nil {
+			return err
+		}
+		text := fmt.Sprintf(":rotating_light: Instagram extraction failed for %s: %s\n```%s```", post.URL, problem, htmlSnippet(page, canarySnippetLen))
+		if err := h.alertAdmin(ctx, text); err != nil {
+			h.store.Delete(ctx, key)
+			return err
+		}
+	}
+
+	return fmt.Errorf("%s: %s", post.URL, problem)
+}
+
+func validateCanaryMeta(post *CanaryPost, meta *InstaMeta) []string {
+	var missing []string
+
+	if meta.ImageURL == "" {
+		missing = append(missing, "no image url")
+	}
+	if meta.Username == "" {
+		missing = append(missing, "no owner")
+	}
+	if meta.PartCount < 1 || (post.PartCount > 0 && meta.PartCount != post.PartCount) {
+		missing = append(missing, fmt.Sprintf("part count %d, expected %d", meta.PartCount, post.PartCount))
+	}
+
+	return missing
+}
+
+// htmlSnippet picks the part of a page most likely to show what changed:
+// the embedded post data if it's there, else the start of the body.
+func htmlSnippet(page *pageData, n int) string {
+	data := page.AdditionalData
+	if data == nil {
+		data = page.SharedData
+	}
+	if data == nil {
+		data = page.Prefix
+		if i := bytes.Index(data, []byte("<body")); i >= 0 {
+			data = data[i:]
+		}
+	}
+
+	if len(data) > n {
+		data = data[:n]
+	}
+
+	return strings.ReplaceAll(string(data), "```", "'''")
+}
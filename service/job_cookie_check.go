@@ -0,0 +1,75 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerJob(&job{
+		name:  "cookie_check",
+		every: time.Hour,
+		enabled: func(cfg *Config) bool {
+			return cfg.CookieCheckURL != ""
+		},
+		run: func(ctx context.Context, h *handler) error {
+			return h.checkCookies(ctx)
+		},
+	})
+}
+
+// checkCookies fetches a known post with each session to make sure it
+// still gets us past the login wall, putting recovered sessions back
+// into rotation.
+func (h *handler) checkCookies(ctx context.Context) error {
+	var failed []string
+
+	for _, sc := range h.config.sessions() {
+		if err := h.checkSession(ctx, h.loadSession(ctx, sc)); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", sc.Name, err))
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("fetching %s: %s", h.config.CookieCheckURL, strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func (h *handler) checkSession(ctx context.Context, s *session) error {
+	return h.checkSessionAt(ctx, s, h.config.CookieCheckURL)
+}
+
+func (h *handler) checkSessionAt(ctx context.Context, s *session, checkURL string) error {
+	page, err := h.fetchInstaPageWith(ctx, checkURL, s)
+	if err == errLoginWall {
+		if h.sessionHealthy(ctx, s.name) {
+			h.markSessionUnhealthy(ctx, s.name, err)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if err := checkSessionPage(page, checkURL); err != nil {
+		return err
+	}
+
+	h.markSessionHealthy(ctx, s.name)
+	return nil
+}
+
+// checkSessionPage checks a fetched post has what a logged in session
+// sees.
+func checkSessionPage(page *pageData, checkURL string) error {
+	meta, err := extractMeta(page, checkURL, 0)
+	if err != nil {
+		return err
+	}
+	if meta.Username == "" || meta.ImageURL == "" {
+		return fmt.Errorf("incomplete metadata, cookie may be logged out")
+	}
+	return nil
+}
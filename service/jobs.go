@@ -0,0 +1,219 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+const (
+	defaultJobTimeout = time.Minute
+
+	// scheduleSlack lets a job run a little early, since scheduled
+	// invocations and tickers don't fire at exact intervals.
+	scheduleSlack = 30 * time.Second
+)
+
+// JobConfig overrides a registered job's schedule.
+type JobConfig struct {
+	Every    Duration `json:"every,omitempty"`
+	Disabled bool     `json:"disabled,omitempty"`
+}
+
+// JobStatus is kept in the store after each run of a job.
+type JobStatus struct {
+	Name        string        `json:"name"`
+	LastStart   time.Time     `json:"last_start"`
+	LastFinish  time.Time     `json:"last_finish"`
+	LastSuccess time.Time     `json:"last_success,omitempty"`
+	LastError   string        `json:"last_error,omitempty"`
+	Took        time.Duration `json:"took"`
+	Runs        int           `json:"runs"`
+	// Failures counts consecutive failed runs.
+	Failures int `json:"failures"`
+}
+
+// job is a periodic maintenance task. Jobs run from scheduled Lambda
+// invocations or the server mode ticker, whichever fires first once the
+// job is due.
+type job struct {
+	name    string
+	every   time.Duration
+	timeout time.Duration
+	// enabled reports whether the job has what it needs in config.
+	enabled func(cfg *Config) bool
+	run     func(ctx context.Context, h *handler) error
+}
+
+var jobs = map[string]*job{}
+
+func registerJob(j *job) {
+	if _, ok := jobs[j.name]; ok {
+		panic(fmt.Sprintf("job %s registered twice", j.name))
+	}
+	jobs[j.name] = j
+}
+
+func jobNames() []string {
+	names := make([]string, 0, len(jobs))
+	for name := range jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func jobStatusKey(name string) string {
+	return "job/" + name + "/status"
+}
+
+func jobLockKey(name string) string {
+	return "job/" + name + "/lock"
+}
+
+// interval is the job's configured schedule, or zero if it's disabled.
+func (h *handler) jobInterval(j *job) time.Duration {
+	if j.enabled != nil && !j.enabled(h.config) {
+		return 0
+	}
+
+	if jc, ok := h.config.Jobs[j.name]; ok && jc != nil {
+		if jc.Disabled {
+			return 0
+		}
+		if jc.Every.Duration > 0 {
+			return jc.Every.Duration
+		}
+	}
+
+	return j.every
+}
+
+func (h *handler) jobStatus(ctx context.Context, name string) (*JobStatus, error) {
+	status := &JobStatus{Name: name}
+
+	data, err := h.store.Get(ctx, jobStatusKey(name))
+	if err == errNotFound {
+		return status, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (h *handler) putJobStatus(ctx context.Context, status *JobStatus) error {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return h.store.Put(ctx, jobStatusKey(status.Name), data, 0)
+}
+
+// runDueJobs runs each enabled job whose interval has passed since it
+// last started, one at a time and in name order.
+func (h *handler) runDueJobs(ctx context.Context, now time.Time) {
+	for _, name := range jobNames() {
+		if ctx.Err() != nil {
+			return
+		}
+
+		j := jobs[name]
+
+		every := h.jobInterval(j)
+		if every <= 0 {
+			continue
+		}
+
+		status, err := h.jobStatus(ctx, name)
+		if err != nil {
+			log.Printf("Error loading status for job %s: %s", name, err)
+			continue
+		}
+
+		if !status.LastStart.IsZero() && now.Sub(status.LastStart) < every-scheduleSlack {
+			continue
+		}
+
+		h.runJob(ctx, j, status)
+	}
+}
+
+func (h *handler) runJob(ctx context.Context, j *job, status *JobStatus) {
+	timeout := j.timeout
+	if timeout <= 0 {
+		timeout = defaultJobTimeout
+	}
+
+	// several instances may be woken by the same schedule
+	n, err := h.store.Add(ctx, jobLockKey(j.name), 1, timeout)
+	if err != nil {
+		log.Printf("Error locking job %s: %s", j.name, err)
+		return
+	}
+	if n != 1 {
+		log.Printf("Job %s is already running", j.name)
+		return
+	}
+	defer h.store.Delete(ctx, jobLockKey(j.name))
+
+	jctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	status.LastStart = time.Now().UTC()
+
+	log.Printf("Running job %s", j.name)
+	err = j.run(jctx, h)
+
+	status.LastFinish = time.Now().UTC()
+	status.Took = status.LastFinish.Sub(status.LastStart)
+	status.Runs++
+
+	if err != nil {
+		status.LastError = err.Error()
+		status.Failures++
+		log.Printf("Job %s failed after %s (%d in a row): %s", j.name, status.Took, status.Failures, err)
+	} else {
+		status.LastError = ""
+		status.LastSuccess = status.LastFinish
+		status.Failures = 0
+		log.Printf("Job %s done in %s", j.name, status.Took)
+	}
+
+	if err := h.putJobStatus(ctx, status); err != nil {
+		log.Printf("Error storing status for job %s: %s", j.name, err)
+	}
+}
+
+// RunScheduler runs due jobs every interval until ctx is done. It's the
+// server mode equivalent of a scheduled Lambda invocation.
+func RunScheduler(ctx context.Context, lh lambda.Handler, interval time.Duration) {
+	h, ok := lh.(*handler)
+	if !ok {
+		log.Printf("Scheduler needs a handler from NewHandler, got %T", lh)
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	h.runDueJobs(ctx, time.Now())
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-ticker.C:
+			h.runDueJobs(ctx, t)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunDueJobs(t *testing.T) {
+	ctx := context.Background()
+
+	runs := 0
+	fail := false
+
+	registerJob(&job{
+		name:  "test_job",
+		every: 10 * time.Minute,
+		run: func(ctx context.Context, h *handler) error {
+			runs++
+			if fail {
+				return errors.New("boom")
+			}
+			return nil
+		},
+	})
+	defer delete(jobs, "test_job")
+
+	h := &handler{config: &Config{}, store: newMemoryStore()}
+
+	now := time.Now()
+	h.runDueJobs(ctx, now)
+	h.runDueJobs(ctx, now.Add(time.Minute))
+	if runs != 1 {
+		t.Fatalf("expected job to run once, ran %d times", runs)
+	}
+
+	fail = true
+	h.runDueJobs(ctx, now.Add(11*time.Minute))
+	if runs != 2 {
+		t.Fatalf("expected job to run again once due, ran %d times", runs)
+	}
+
+	status, err := h.jobStatus(ctx, "test_job")
+	if err != nil {
+		t.Fatalf("status: %s", err)
+	}
+	if status.Runs != 2 || status.Failures != 1 || status.LastError != "boom" || status.LastSuccess.IsZero() {
+		t.Errorf("unexpected status %#v", status)
+	}
+
+	if _, err := h.store.Get(ctx, jobLockKey("test_job")); err != errNotFound {
+		t.Errorf("expected lock to be released")
+	}
+
+	h.config.Jobs = map[string]*JobConfig{"test_job": {Disabled: true}}
+	h.runDueJobs(ctx, now.Add(time.Hour))
+	if runs != 2 {
+		t.Errorf("expected disabled job not to run")
+	}
+}
+
+func TestCanaryAlerts(t *testing.T) {
+	ctx := context.Background()
+
+	e := newE2E(t, "synthetic_carousel")
+	e.h.config.Admin = &AdminConfig{Token: "xoxb-admin", Channel: "CADMIN"}
+	post := &CanaryPost{URL: "https://www.instagram.com/p/CA1lPepDJXO/", PartCount: 5}
+
+	alerts := func() []string {
+		var texts []string
+		for _, c := range e.slack.Calls("chat.postMessage") {
+			texts = append(texts, c.Form.Get("text"))
+		}
+		return texts
+	}
+
+	for i := 0; i < 2; i++ {
+		err := e.h.checkCanaryPost(ctx, post)
+		if err == nil || !strings.Contains(err.Error(), "part count 3, expected 5") {
+			t.Fatalf("expected a part count mismatch, got %v", err)
+		}
+	}
+
+	if texts := alerts(); len(texts) != 1 || !strings.Contains(texts[0], ":rotating_light:") || !strings.Contains(texts[0], "part count 3, expected 5") {
+		t.Fatalf("expected one failure alert, got %q", texts)
+	}
+
+	post.PartCount = 3
+	for i := 0; i < 2; i++ {
+		if err := e.h.checkCanaryPost(ctx, post); err != nil {
+			t.Fatalf("expected the canary to pass, got %s", err)
+		}
+	}
+
+	if texts := alerts(); len(texts) != 2 || !strings.Contains(texts[1], "works again") {
+		t.Errorf("expected one recovery alert, got %q", texts)
+	}
+}
+
+func TestCanaryAlertRetriedWhenNotSent(t *testing.T) {
+	ctx := context.Background()
+
+	e := newE2E(t, "synthetic_carousel")
+	e.h.config.Admin = &AdminConfig{Token: "xoxb-admin", Channel: "CADMIN"}
+	post := &CanaryPost{URL: "https://www.instagram.com/p/CA1lPepDJXO/", PartCount: 5}
+
+	e.slack.FailWith("chat.postMessage", "channel_not_found", 1)
+	e.h.checkCanaryPost(ctx, post)
+	e.h.checkCanaryPost(ctx, post)
+
+	if calls := e.slack.Calls("chat.postMessage"); len(calls) != 2 {
+		t.Errorf("expected the alert to be tried again after failing, got %d calls", len(calls))
+	}
+}
+
+func TestHTMLSnippet(t *testing.T) {
+	page := &pageData{
+		Prefix:     []byte("<html><head><title>x</title></head><body><div>hello</div>"),
+		SharedData: []byte(`{"shared":1}`),
+	}
+
+	if s := htmlSnippet(page, 100); s != `{"shared":1}` {
+		t.Errorf("expected shared data, got %q", s)
+	}
+
+	page.AdditionalData = []byte("{\"code\":\"```\"}")
+	if s := htmlSnippet(page, 100); s != `{"code":"'''"}` {
+		t.Errorf("expected additional data with fences escaped, got %q", s)
+	}
+
+	page.AdditionalData, page.SharedData = nil, nil
+	if s := htmlSnippet(page, 12); s != "<body><div>h" {
+		t.Errorf("expected the start of the body, truncated, got %q", s)
+	}
+}
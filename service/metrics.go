@@ -0,0 +1,429 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+const (
+	defaultMetricsNamespace = "SlackInstagram"
+
+	// emfMaxValues is how many values CloudWatch takes per metric per line.
+	emfMaxValues = 100
+	// emfMaxPending caps the histogram values a series keeps between
+	// flushes; later ones only reach Prometheus.
+	emfMaxPending = 10 * emfMaxValues
+)
+
+var defaultLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// metricDef describes a metric. Histograms are in seconds; their counts
+// double as counters of whatever is being timed, by label.
+type metricDef struct {
+	name      string
+	help      string
+	labels    []string
+	histogram bool
+	buckets   []float64
+}
+
+var (
+	metricSlashCommand = &metricDef{
+		name:      "slash_command_seconds",
+		help:      "Time taken to answer slash commands, by result.",
+		labels:    []string{"result"},
+		histogram: true,
+		buckets:   defaultLatencyBuckets,
+	}
+	metricQueueSend = &metricDef{
+		name:      "queue_send_seconds",
+		help:      "Time taken to enqueue messages, by message type and result.",
+		labels:    []string{"type", "result"},
+		histogram: true,
+		buckets:   defaultLatencyBuckets,
+	}
+	metricQueueLag = &metricDef{
+		name:      "queue_lag_seconds",
+		help:      "Age of queued messages when they're picked up, by message type.",
+		labels:    []string{"type"},
+		histogram: true,
+		buckets:   []float64{1, 2, 5, 10, 30, 60, 300, 1800},
+	}
+	metricInstaFetch = &metricDef{
+		name:      "instagram_fetch_seconds",
+		help:      "Time taken to fetch and extract instagram posts, by outcome.",
+		labels:    []string{"outcome"},
+		histogram: true,
+		buckets:   defaultLatencyBuckets,
+	}
+	metricExtractStrategy = &metricDef{
+		name:   "extraction_strategy_total",
+		help:   "Instagram pages parsed, by the extraction strategy that matched.",
+		labels: []string{"strategy"},
+	}
+	metricSlackCall = &metricDef{
+		name:      "slack_call_seconds",
+		help:      "Time taken by calls to slack, by method and result.",
+		labels:    []string{"method", "result"},
+		histogram: true,
+		buckets:   defaultLatencyBuckets,
+	}
+)
+
+// metrics is a small registry kept by each handler. It holds cumulative
+// values for Prometheus, and the values observed since the last flush for
+// CloudWatch embedded metric format (EMF) log lines.
+type metrics struct {
+	mu     sync.Mutex
+	series map[string]*metricSeries
+	// emf is set when values are flushed as EMF, and so worth keeping
+	emf bool
+}
+
+type metricSeries struct {
+	def    *metricDef
+	labels []string
+
+	count   uint64
+	sum     float64
+	buckets []uint64
+
+	pending []float64
+}
+
+func newMetrics() *metrics {
+	return &metrics{series: make(map[string]*metricSeries)}
+}
+
+// observe records v for the series with the given label values, in the
+// order of def.labels. Counters are incremented by v. A nil registry,
+// as in handlers not built by NewHandler, drops everything.
+func (m *metrics) observe(def *metricDef, v float64, labels ...string) {
+	if m == nil {
+		return
+	}
+
+	key := def.name + "\xff" + strings.Join(labels, "\xff")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{def: def, labels: labels, buckets: make([]uint64, len(def.buckets))}
+		m.series[key] = s
+	}
+
+	s.count++
+	s.sum += v
+	for i, b := range def.buckets {
+		if v <= b {
+			s.buckets[i]++
+		}
+	}
+	switch {
+	case !m.emf:
+	case !def.histogram && len(s.pending) > 0:
+		s.pending[0] += v
+	case len(s.pending) < emfMaxPending:
+		s.pending = append(s.pending, v)
+	}
+}
+
+func (m *metrics) sorted() []*metricSeries {
+	list := make([]*metricSeries, 0, len(m.series))
+	for _, s := range m.series {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].def.name != list[j].def.name {
+			return list[i].def.name < list[j].def.name
+		}
+		return strings.Join(list[i].labels, "\xff") < strings.Join(list[j].labels, "\xff")
+	})
+	return list
+}
+
+// writePrometheus writes every series in the Prometheus text format.
+func (m *metrics) writePrometheus(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var last *metricDef
+	for _, s := range m.sorted() {
+		def := s.def
+		if def != last {
+			kind := "counter"
+			if def.histogram {
+				kind = "histogram"
+			}
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", def.name, def.help, def.name, kind)
+			last = def
+		}
+
+		if !def.histogram {
+			fmt.Fprintf(w, "%s%s %s\n", def.name, promLabels(def.labels, s.labels, ""), promFloat(s.sum))
+			continue
+		}
+
+		for i, b := range def.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", def.name, promLabels(def.labels, s.labels, promFloat(b)), s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", def.name, promLabels(def.labels, s.labels, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", def.name, promLabels(def.labels, s.labels, ""), promFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", def.name, promLabels(def.labels, s.labels, ""), s.count)
+	}
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func promLabels(names, values []string, le string) string {
+	parts := make([]string, 0, len(names)+1)
+	for i, n := range names {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, n, promEscaper.Replace(values[i])))
+	}
+	if le != "" {
+		parts = append(parts, fmt.Sprintf(`le="%s"`, le))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func promFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+type emfMetric struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+type emfDirective struct {
+	Namespace  string      `json:"Namespace"`
+	Dimensions [][]string  `json:"Dimensions"`
+	Metrics    []emfMetric `json:"Metrics"`
+}
+
+type emfMetadata struct {
+	Timestamp         int64          `json:"Timestamp"`
+	CloudWatchMetrics []emfDirective `json:"CloudWatchMetrics"`
+}
+
+// writeEMF writes a CloudWatch EMF log line for each series observed
+// since the last call, with the labels as dimensions. Counters are
+// summed; histogram values are sent as they are, for CloudWatch to
+// aggregate.
+func (m *metrics) writeEMF(w io.Writer, namespace string, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, s := range m.sorted() {
+		pending := s.pending
+		s.pending = nil
+		if len(pending) == 0 {
+			continue
+		}
+
+		unit := "Seconds"
+		if !s.def.histogram {
+			unit = "Count"
+			sum := 0.0
+			for _, v := range pending {
+				sum += v
+			}
+			pending = []float64{sum}
+		}
+
+		for len(pending) > 0 {
+			n := len(pending)
+			if n > emfMaxValues {
+				n = emfMaxValues
+			}
+
+			line := map[string]interface{}{
+				"_aws": &emfMetadata{
+					Timestamp: now.UnixNano() / int64(time.Millisecond),
+					CloudWatchMetrics: []emfDirective{{
+						Namespace:  namespace,
+						Dimensions: [][]string{s.def.labels},
+						Metrics:    []emfMetric{{Name: s.def.name, Unit: unit}},
+					}},
+				},
+				s.def.name: pending[:n],
+			}
+			for i, l := range s.def.labels {
+				line[l] = s.labels[i]
+			}
+
+			data, err := json.Marshal(line)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "%s\n", data); err != nil {
+				return err
+			}
+
+			pending = pending[n:]
+		}
+	}
+
+	return nil
+}
+
+// WithEMF writes the metrics observed during each invocation to w as
+// CloudWatch EMF log lines when it ends. Under Lambda, w is stdout.
+func WithEMF(w io.Writer) HandlerOption {
+	return func(h *handler) {
+		h.emf = w
+		if h.metrics != nil {
+			h.metrics.emf = true
+		}
+	}
+}
+
+func (h *handler) flushMetrics() {
+	if h.emf == nil || h.metrics == nil {
+		return
+	}
+
+	ns := h.config.MetricsNamespace
+	if ns == "" {
+		ns = defaultMetricsNamespace
+	}
+
+	if err := h.metrics.writeEMF(h.emf, ns, time.Now()); err != nil {
+		log.Printf("Error writing metrics: %s", err)
+	}
+}
+
+// MetricsHandler serves the handler's metrics in the Prometheus text
+// format, for server mode.
+func MetricsHandler(lh lambda.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, ok := lh.(*handler)
+		if !ok {
+			http.Error(w, fmt.Sprintf("metrics need a handler from NewHandler, got %T", lh), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if h.metrics != nil {
+			h.metrics.writePrometheus(w)
+		}
+	})
+}
+
+// resultLabel is "ok" or "error".
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// instaOutcome classifies the result of an instagram fetch.
+func instaOutcome(ctx context.Context, err error) string {
+	var (
+		open    *circuitOpenError
+		status  *httpStatusError
+		extract *extractError
+		netErr  net.Error
+	)
+
+	switch {
+	case err == nil:
+		return "ok"
+	case err == errLoginWall:
+		return "login_wall"
+	case errors.As(err, &open):
+		return "circuit_open"
+	case errors.As(err, &extract):
+		return "extract_failed"
+	case errors.As(err, &status):
+		switch {
+		case status.code == http.StatusNotFound:
+			return "not_found"
+		case status.code == http.StatusTooManyRequests:
+			return "rate_limited"
+		case status.code >= 500:
+			return "server_error"
+		}
+		return "client_error"
+	case ctx.Err() != nil, errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+	return "network"
+}
+
+// observeSlackCall records a call to slack that started at start and
+// ended with *err; it's meant to be deferred.
+func (h *handler) observeSlackCall(method string, start time.Time, err *error) {
+	h.metrics.observe(metricSlackCall, time.Since(start).Seconds(), method, slackResult(*err))
+}
+
+// slackErrorResults groups slack's error codes into the few results
+// recorded, since each label value is a separate CloudWatch metric.
+var slackErrorResults = map[string]string{
+	"ratelimited":            "ratelimited",
+	"invalid_auth":           "auth",
+	"not_authed":             "auth",
+	"token_revoked":          "auth",
+	"token_expired":          "auth",
+	"account_inactive":       "auth",
+	"missing_scope":          "auth",
+	"not_allowed_token_type": "auth",
+	"channel_not_found":      "not_found",
+	"user_not_found":         "not_found",
+	"not_in_channel":         "not_found",
+	"is_archived":            "not_found",
+	"internal_error":         "server_error",
+	"fatal_error":            "server_error",
+	"service_unavailable":    "server_error",
+	"request_timeout":        "server_error",
+}
+
+// slackResult is "ok", "ratelimited", "auth", "not_found",
+// "client_error", "server_error" or, when slack wasn't reached,
+// "network".
+func slackResult(err error) string {
+	var (
+		se     *slackError
+		status *httpStatusError
+	)
+
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.As(err, &se):
+		if r, ok := slackErrorResults[se.code]; ok {
+			return r
+		}
+		return "client_error"
+	case errors.As(err, &status):
+		switch {
+		case status.code == http.StatusTooManyRequests:
+			return "ratelimited"
+		case status.code == http.StatusNotFound:
+			return "not_found"
+		case status.code >= 500:
+			return "server_error"
+		}
+		return "client_error"
+	}
+	return "network"
+}
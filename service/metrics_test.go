@@ -0,0 +1,161 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsPrometheus(t *testing.T) {
+	m := newMetrics()
+	m.observe(metricExtractStrategy, 1, "og_meta")
+	m.observe(metricExtractStrategy, 1, "og_meta")
+	m.observe(metricInstaFetch, 0.2, "ok")
+	m.observe(metricInstaFetch, 3, "ok")
+	m.observe(metricSlackCall, 0.01, "chat.unfurl", `bad"result`)
+
+	buf := &bytes.Buffer{}
+	m.writePrometheus(buf)
+	out := buf.String()
+
+	for _, want := range []string{
+		"# TYPE extraction_strategy_total counter\nextraction_strategy_total{strategy=\"og_meta\"} 2\n",
+		"# TYPE instagram_fetch_seconds histogram\n",
+		`instagram_fetch_seconds_bucket{outcome="ok",le="0.25"} 1`,
+		`instagram_fetch_seconds_bucket{outcome="ok",le="5"} 2`,
+		`instagram_fetch_seconds_bucket{outcome="ok",le="+Inf"} 2`,
+		`instagram_fetch_seconds_sum{outcome="ok"} 3.2`,
+		`instagram_fetch_seconds_count{outcome="ok"} 2`,
+		`slack_call_seconds_count{method="chat.unfurl",result="bad\"result"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in\n%s", want, out)
+		}
+	}
+}
+
+func TestMetricsEMF(t *testing.T) {
+	m := newMetrics()
+	m.emf = true
+	m.observe(metricExtractStrategy, 1, "og_meta")
+	m.observe(metricExtractStrategy, 1, "og_meta")
+	for i := 0; i < emfMaxValues+1; i++ {
+		m.observe(metricQueueLag, 2, SQSMessageTypeSlash)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := m.writeEMF(buf, "Test", time.Unix(1600000000, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected three lines, got %d:\n%s", len(lines), buf)
+	}
+
+	first := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"CloudWatchMetrics":[{"Dimensions":[["strategy"]],"Metrics":[{"Name":"extraction_strategy_total","Unit":"Count"}],"Namespace":"Test"}],"Timestamp":1600000000000}`
+	if got, _ := json.Marshal(first["_aws"]); string(got) != want {
+		t.Errorf("unexpected metadata %s", got)
+	}
+	if first["strategy"] != "og_meta" || first["extraction_strategy_total"].([]interface{})[0] != float64(2) {
+		t.Errorf("unexpected line %s", lines[0])
+	}
+	if !strings.Contains(lines[1], `"Unit":"Seconds"`) || strings.Count(lines[1], "2,") != emfMaxValues-1 {
+		t.Errorf("expected a full line of queue lags, got %s", lines[1])
+	}
+
+	// pending values are sent once
+	buf.Reset()
+	m.writeEMF(buf, "Test", time.Now())
+	if buf.Len() != 0 {
+		t.Errorf("expected nothing new, got %s", buf)
+	}
+}
+
+func TestMetricsInstrumentation(t *testing.T) {
+	e := newE2E(t, "synthetic_single", "synthetic_not_found")
+	emf := &bytes.Buffer{}
+	WithEMF(emf)(e.h)
+
+	e.slashCommand("https://www.instagram.com/p/B_single01/", "r1")
+	e.slashCommand("https://www.instagram.com/p/B_missing1/", "r2")
+	e.slashCommand("not a url", "r3")
+	e.deliver()
+
+	rec := httptest.NewRecorder()
+	MetricsHandler(e.h).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	out := rec.Body.String()
+
+	for _, want := range []string{
+		`slash_command_seconds_count{result="queued"} 2`,
+		`slash_command_seconds_count{result="usage"} 1`,
+		`queue_send_seconds_count{type="slash_command",result="ok"} 2`,
+		`queue_lag_seconds_count{type="slash_command"} 2`,
+		`instagram_fetch_seconds_count{outcome="ok"} 1`,
+		`instagram_fetch_seconds_count{outcome="not_found"} 1`,
+		`extraction_strategy_total{strategy="additional_data"} 1`,
+		`slack_call_seconds_count{method="response_url",result="ok"} 2`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in\n%s", want, out)
+		}
+	}
+
+	if !strings.Contains(emf.String(), `"instagram_fetch_seconds"`) {
+		t.Errorf("expected EMF lines after invocations, got\n%s", emf)
+	}
+}
+
+func TestMetricsPendingOnlyForEMF(t *testing.T) {
+	m := newMetrics()
+	m.observe(metricQueueLag, 2, SQSMessageTypeSlash)
+	for _, s := range m.series {
+		if len(s.pending) != 0 {
+			t.Errorf("expected nothing kept for EMF without it, got %d values", len(s.pending))
+		}
+	}
+
+	m.emf = true
+	for i := 0; i < emfMaxPending+10; i++ {
+		m.observe(metricQueueLag, 2, SQSMessageTypeSlash)
+		m.observe(metricExtractStrategy, 1, "og_meta")
+	}
+	for _, s := range m.series {
+		if len(s.pending) > emfMaxPending {
+			t.Errorf("expected %s to keep at most %d values, got %d", s.def.name, emfMaxPending, len(s.pending))
+		}
+		if !s.def.histogram && (len(s.pending) != 1 || s.pending[0] != emfMaxPending+10) {
+			t.Errorf("expected counters to keep a running sum, got %v", s.pending)
+		}
+	}
+}
+
+func TestSlackResult(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want string
+	}{
+		{nil, "ok"},
+		{(&slackAPIResponse{Error: "ratelimited"}).err("m"), "ratelimited"},
+		{(&slackAPIResponse{Error: "token_revoked"}).err("m"), "auth"},
+		{(&slackAPIResponse{Error: "channel_not_found"}).err("m"), "not_found"},
+		{(&slackAPIResponse{Error: "some_new_code"}).err("m"), "client_error"},
+		{(&slackAPIResponse{Error: "internal_error"}).err("m"), "server_error"},
+		{statusError("m", 503), "server_error"},
+		{statusError("m", 429), "ratelimited"},
+		{statusError("m", 400), "client_error"},
+		{errors.New("connection refused"), "network"},
+	} {
+		if got := slackResult(c.err); got != c.want {
+			t.Errorf("expected %s for %v, got %s", c.want, c.err, got)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Queue is the part of the SQS client the handler uses; *sqs.SQS
+// implements it.
+type Queue interface {
+	SendMessageWithContext(ctx aws.Context, input *sqs.SendMessageInput, opts ...request.Option) (*sqs.SendMessageOutput, error)
+	// GetQueueAttributesWithContext is only used to check the queue is
+	// reachable.
+	GetQueueAttributesWithContext(ctx aws.Context, input *sqs.GetQueueAttributesInput, opts ...request.Option) (*sqs.GetQueueAttributesOutput, error)
+}
+
+// MemoryQueue is an in-process Queue for tests and local development.
+// Messages sit in it until Deliver hands them to a handler the way the
+// Lambda SQS trigger would.
+type MemoryQueue struct {
+	mu       sync.Mutex
+	nextID   int
+	messages []*memoryQueueMessage
+}
+
+type memoryQueueMessage struct {
+	id       string
+	queueURL string
+	body     string
+	attrs    map[string]*sqs.MessageAttributeValue
+	received int
+	sentAt   time.Time
+}
+
+func NewMemoryQueue() *MemoryQueue {
+	return &MemoryQueue{}
+}
+
+func (q *MemoryQueue) SendMessageWithContext(ctx aws.Context, input *sqs.SendMessageInput, opts ...request.Option) (*sqs.SendMessageOutput, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.nextID++
+	id := fmt.Sprintf("msg-%d", q.nextID)
+
+	q.messages = append(q.messages, &memoryQueueMessage{
+		id:       id,
+		queueURL: aws.StringValue(input.QueueUrl),
+		body:     aws.StringValue(input.MessageBody),
+		attrs:    input.MessageAttributes,
+		sentAt:   time.Now(),
+	})
+
+	return &sqs.SendMessageOutput{MessageId: aws.String(id)}, nil
+}
+
+// GetQueueAttributesWithContext reports the number of waiting messages as
+// ApproximateNumberOfMessages; any queue url is valid.
+func (q *MemoryQueue) GetQueueAttributesWithContext(ctx aws.Context, input *sqs.GetQueueAttributesInput, opts ...request.Option) (*sqs.GetQueueAttributesOutput, error) {
+	n := q.Len(aws.StringValue(input.QueueUrl))
+	return &sqs.GetQueueAttributesOutput{
+		Attributes: map[string]*string{
+			sqs.QueueAttributeNameApproximateNumberOfMessages: aws.String(strconv.Itoa(n)),
+		},
+	}, nil
+}
+
+// Len is the number of messages waiting on queueURL.
+func (q *MemoryQueue) Len(queueURL string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := 0
+	for _, m := range q.messages {
+		if m.queueURL == queueURL {
+			n++
+		}
+	}
+	return n
+}
+
+// Bodies returns the bodies of messages waiting on queueURL.
+func (q *MemoryQueue) Bodies(queueURL string) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var bodies []string
+	for _, m := range q.messages {
+		if m.queueURL == queueURL {
+			bodies = append(bodies, m.body)
+		}
+	}
+	return bodies
+}
+
+// Deliver invokes h with every message waiting on queueURL as one SQS
+// event. Messages reported as batch item failures go back on the queue,
+// the rest are deleted. It returns how many were delivered and failed.
+func (q *MemoryQueue) Deliver(ctx context.Context, h lambda.Handler, queueURL string) (delivered, failed int, err error) {
+	q.mu.Lock()
+	var batch, rest []*memoryQueueMessage
+	for _, m := range q.messages {
+		if m.queueURL == queueURL {
+			m.received++
+			batch = append(batch, m)
+		} else {
+			rest = append(rest, m)
+		}
+	}
+	q.messages = rest
+	q.mu.Unlock()
+
+	if len(batch) == 0 {
+		return 0, 0, nil
+	}
+
+	evt := &events.SQSEvent{}
+	for _, m := range batch {
+		evt.Records = append(evt.Records, m.record())
+	}
+
+	payload, err := json.Marshal(evt)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	out, err := h.Invoke(ctx, payload)
+
+	failedIDs := make(map[string]bool)
+	if err != nil {
+		// a failed invocation returns the whole batch
+		for _, m := range batch {
+			failedIDs[m.id] = true
+		}
+	} else {
+		resp := &SQSEventResponse{}
+		if err := json.Unmarshal(out, resp); err != nil {
+			return len(batch), 0, err
+		}
+		for _, f := range resp.BatchItemFailures {
+			failedIDs[f.ItemIdentifier] = true
+		}
+	}
+
+	q.mu.Lock()
+	var requeue []*memoryQueueMessage
+	for _, m := range batch {
+		if failedIDs[m.id] {
+			requeue = append(requeue, m)
+		}
+	}
+	q.messages = append(requeue, q.messages...)
+	q.mu.Unlock()
+
+	return len(batch), len(requeue), err
+}
+
+func (m *memoryQueueMessage) record() events.SQSMessage {
+	attrs := make(map[string]events.SQSMessageAttribute, len(m.attrs))
+	for k, v := range m.attrs {
+		attrs[k] = events.SQSMessageAttribute{
+			StringValue: v.StringValue,
+			DataType:    aws.StringValue(v.DataType),
+		}
+	}
+
+	return events.SQSMessage{
+		MessageId:     m.id,
+		ReceiptHandle: m.id,
+		Body:          m.body,
+		Attributes: map[string]string{
+			"ApproximateReceiveCount": strconv.Itoa(m.received),
+			"SentTimestamp":           strconv.FormatInt(m.sentAt.UnixNano()/int64(time.Millisecond), 10),
+		},
+		MessageAttributes: attrs,
+		EventSource:       "aws:sqs",
+		EventSourceARN:    "arn:aws:sqs:local:000000000000:" + m.queueURL,
+	}
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+)
+
+// QuotaConfig limits how much one user or team can fetch. Zero means no
+// limit. Windows are fixed: calendar minutes and UTC days.
+type QuotaConfig struct {
+	UserPerMinute int `json:"user_per_minute,omitempty"`
+	TeamPerDay    int `json:"team_per_day,omitempty"`
+}
+
+// quotaExceeded describes the quota a request ran into.
+type quotaExceeded struct {
+	what   string
+	limit  int
+	period string
+	resets time.Time
+}
+
+// message is the "slow down" reply for the user.
+func (q *quotaExceeded) message() string {
+	return fmt.Sprintf("Slow down! %s used all %d instagram fetches per %s (%s and link unfurls both count). Try again <!date^%d^{time_secs}|at %s>.",
+		q.what, q.limit, q.period, slashCommand, q.resets.Unix(), q.resets.UTC().Format("15:04:05 UTC"))
+}
+
+func quotaWindow(now time.Time, period time.Duration) (start, end time.Time) {
+	start = now.UTC().Truncate(period)
+	return start, start.Add(period)
+}
+
+// Quota counters have one key each, expiring at the end of the window
+// they were started in, after which the next request starts a new one.
+func quotaUserKey(team teamKey, userID string) string {
+	return fmt.Sprintf("quota/user/%s/%s", team, userID)
+}
+
+func quotaTeamKey(team teamKey) string {
+	return fmt.Sprintf("quota/team/%s", team)
+}
+
+// checkQuota counts a request against the user's and the team's quota
+// and returns the first one it exceeds, if any. A request the team quota
+// rejects isn't left counted against the user. Store errors let the
+// request through.
+func (h *handler) checkQuota(ctx context.Context, team teamKey, userID string) *quotaExceeded {
+	q := h.config.Quotas
+	if q == nil {
+		return nil
+	}
+
+	now := time.Now()
+
+	// uncount gives back the user's request if the team quota rejects it
+	uncount := func() {}
+
+	if q.UserPerMinute > 0 && userID != "" {
+		_, end := quotaWindow(now, time.Minute)
+		key := quotaUserKey(team, userID)
+		if n, err := h.store.Add(ctx, key, 1, end.Sub(now)); err != nil {
+			log.Printf("Error counting quota for user %s: %s", userID, err)
+		} else if n > int64(q.UserPerMinute) {
+			return &quotaExceeded{what: "You've", limit: q.UserPerMinute, period: "minute", resets: end}
+		} else {
+			uncount = func() {
+				if _, err := h.store.Add(ctx, key, -1, end.Sub(now)); err != nil {
+					log.Printf("Error uncounting quota for user %s: %s", userID, err)
+				}
+			}
+		}
+	}
+
+	if q.TeamPerDay > 0 {
+		_, end := quotaWindow(now, 24*time.Hour)
+		if n, err := h.store.Add(ctx, quotaTeamKey(team), 1, end.Sub(now)); err != nil {
+			log.Printf("Error counting quota for team %s: %s", team, err)
+		} else if n > int64(q.TeamPerDay) {
+			uncount()
+			return &quotaExceeded{what: "Your team has", limit: q.TeamPerDay, period: "day", resets: end}
+		}
+	}
+
+	return nil
+}
+
+// notifyQuotaExceeded tells a user their link wasn't unfurled, once per
+// quota window.
+func (h *handler) notifyQuotaExceeded(ctx context.Context, team *TeamInfo, channel, userID string, q *quotaExceeded) {
+	if !h.claimOnce(ctx, "quota_notice", dedupID(fmt.Sprintf("%s/%s/%d", team.key(), userID, q.resets.Unix()))) {
+		return
+	}
+
+	token, err := h.botToken(ctx, team)
+	if err != nil {
+		log.Printf("Error getting bot token for quota notice: %s", err)
+		return
+	}
+
+	values := url.Values{
+		"token":   {token},
+		"channel": {channel},
+		"user":    {userID},
+		"text":    {q.message()},
+	}
+
+	if err := h.callSlackForm(ctx, "chat.postEphemeral", values, &slackAPIResponse{}); err != nil {
+		log.Printf("Error sending quota notice to %s: %s", userID, err)
+	}
+}
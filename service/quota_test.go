@@ -0,0 +1,85 @@
+package service
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuotas(t *testing.T) {
+	ctx := context.Background()
+
+	h := &handler{
+		config: &Config{Quotas: &QuotaConfig{UserPerMinute: 2, TeamPerDay: 3}},
+		store:  newMemoryStore(),
+	}
+	team := teamKey{TeamID: "T1"}
+
+	if h.checkQuota(ctx, team, "U1") != nil || h.checkQuota(ctx, team, "U1") != nil {
+		t.Fatalf("expected first two requests to pass")
+	}
+
+	q := h.checkQuota(ctx, team, "U1")
+	if q == nil || q.period != "minute" {
+		t.Fatalf("expected user quota to be exceeded, got %#v", q)
+	}
+
+	// the rejected request doesn't count against the team
+	if h.checkQuota(ctx, team, "U2") != nil {
+		t.Fatalf("expected third team request to pass")
+	}
+
+	if q := h.checkQuota(ctx, team, "U2"); q == nil || q.period != "day" {
+		t.Fatalf("expected team quota to be exceeded, got %#v", q)
+	}
+
+	// nor does the team rejecting it count against the user
+	if n, _ := h.store.Add(ctx, quotaUserKey(team, "U2"), 0, time.Minute); n != 1 {
+		t.Errorf("expected one request counted for U2, got %d", n)
+	}
+
+	body := url.Values{
+		"text":         {"https://www.instagram.com/p/abc/"},
+		"response_url": {"https://hooks.slack.com/commands/1"},
+		"user_id":      {"U3"},
+		"team_id":      {"T1"},
+	}
+
+	msg := h.handleSlashCommand(ctx, body)
+	if !strings.HasPrefix(msg.Text, "Slow down! Your team has used all 3 instagram fetches per day") || !strings.Contains(msg.Text, "link unfurls") || msg.ResponseType != "ephemeral" {
+		t.Errorf("expected slow down reply, got %#v", msg)
+	}
+
+	if err := h.purgeTeam(ctx, team); err != nil {
+		t.Fatalf("purge: %s", err)
+	}
+	if h.checkQuota(ctx, team, "U4") != nil {
+		t.Errorf("expected team quota to be reset by purge")
+	}
+}
+
+func TestQuotaSkipsDuplicateSlashCommands(t *testing.T) {
+	ctx := context.Background()
+
+	h := &handler{
+		config: &Config{Quotas: &QuotaConfig{UserPerMinute: 1}},
+		store:  newMemoryStore(),
+		queue:  NewMemoryQueue(),
+	}
+
+	body := url.Values{
+		"text":         {"https://www.instagram.com/p/abc/"},
+		"response_url": {"https://hooks.slack.com/commands/1"},
+		"trigger_id":   {"trigger-1"},
+		"user_id":      {"U1"},
+		"team_id":      {"T1"},
+	}
+
+	for i := 0; i < 3; i++ {
+		if msg := h.handleSlashCommand(ctx, body); strings.HasPrefix(msg.Text, "Slow down!") {
+			t.Fatalf("expected a retried command not to use quota, got %q on try %d", msg.Text, i+1)
+		}
+	}
+}
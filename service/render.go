@@ -0,0 +1,271 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+
+	"github.com/slack-go/slack"
+)
+
+const (
+	maxSectionTextLen = 3000
+	maxAltTextLen     = 2000
+
+	RenderFieldProfile = "profile"
+	RenderFieldCaption = "caption"
+	RenderFieldImage   = "image"
+	RenderFieldFooter  = "footer"
+
+	defaultHeadlineTemplate = `<@{{.UserID}}> shared this instagram post`
+	defaultFooterTemplate   = `{{if .Date}}{{.Date}} · {{end}}` +
+		`{{if gt .Meta.PartCount 1}}part {{.Part}} of {{.Meta.PartCount}} · {{end}}` +
+		`{{if .Meta.ImageIsVideo}}video · {{end}}` +
+		`<{{.Meta.URL}}|View on Instagram>`
+)
+
+var (
+	mrkdwnEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+	defaultRenderFields = []string{RenderFieldProfile, RenderFieldCaption, RenderFieldImage, RenderFieldFooter}
+
+	defaultRenderer = mustNewRenderer(&RenderConfig{})
+)
+
+// RenderConfig customises how posts are rendered for a team. Headline and
+// Footer are text/template strings executed with a renderData value and
+// producing slack mrkdwn; Fields lists the blocks to include, in order.
+type RenderConfig struct {
+	Headline string   `json:"headline,omitempty"`
+	Footer   string   `json:"footer,omitempty"`
+	Fields   []string `json:"fields,omitempty"`
+
+	renderer *renderer
+}
+
+type renderData struct {
+	UserID string
+	Meta   *InstaMeta
+	Date   string
+	Part   int
+}
+
+// renderer turns InstaMeta into slack blocks. It is shared by slash
+// command responses and link unfurls so the two always look alike.
+type renderer struct {
+	headline *template.Template
+	footer   *template.Template
+	fields   []string
+}
+
+// imageBlock mirrors slack.ImageBlock but omits the title when unset,
+// since slack rejects a null title.
+type imageBlock struct {
+	Type     slack.MessageBlockType `json:"type"`
+	ImageURL string                 `json:"image_url"`
+	AltText  string                 `json:"alt_text"`
+	BlockID  string                 `json:"block_id,omitempty"`
+	Title    *slack.TextBlockObject `json:"title,omitempty"`
+}
+
+func (b imageBlock) BlockType() slack.MessageBlockType {
+	return b.Type
+}
+
+var templateFuncs = template.FuncMap{
+	"escape":   escapeMrkdwn,
+	"truncate": truncate,
+}
+
+func newRenderer(cfg *RenderConfig) (*renderer, error) {
+	r := &renderer{
+		fields: defaultRenderFields,
+	}
+
+	headline := cfg.Headline
+	if headline == "" {
+		headline = defaultHeadlineTemplate
+	}
+
+	footer := cfg.Footer
+	if footer == "" {
+		footer = defaultFooterTemplate
+	}
+
+	var err error
+
+	if r.headline, err = template.New("headline").Funcs(templateFuncs).Parse(headline); err != nil {
+		return nil, fmt.Errorf("headline template: %w", err)
+	}
+
+	if r.footer, err = template.New("footer").Funcs(templateFuncs).Parse(footer); err != nil {
+		return nil, fmt.Errorf("footer template: %w", err)
+	}
+
+	if len(cfg.Fields) > 0 {
+		for _, f := range cfg.Fields {
+			switch f {
+			case RenderFieldProfile, RenderFieldCaption, RenderFieldImage, RenderFieldFooter:
+			default:
+				return nil, fmt.Errorf("unknown render field %q", f)
+			}
+		}
+		r.fields = cfg.Fields
+	}
+
+	return r, nil
+}
+
+func mustNewRenderer(cfg *RenderConfig) *renderer {
+	r, err := newRenderer(cfg)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func escapeMrkdwn(s string) string {
+	return mrkdwnEscaper.Replace(s)
+}
+
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
+
+func mrkdwnText(text string) *slack.TextBlockObject {
+	return slack.NewTextBlockObject(slack.MarkdownType, text, false, false)
+}
+
+func newRenderData(userID string, meta *InstaMeta) *renderData {
+	d := &renderData{
+		UserID: userID,
+		Meta:   meta,
+		Part:   meta.PartIndex + 1,
+	}
+
+	if !meta.TakenAt.IsZero() {
+		d.Date = fmt.Sprintf("<!date^%d^{date_short_pretty}|%s>", meta.TakenAt.Unix(), meta.TakenAt.Format("Jan 2, 2006"))
+	}
+
+	return d
+}
+
+func (r *renderer) execute(t *template.Template, d *renderData) string {
+	buf := &bytes.Buffer{}
+	if err := t.Execute(buf, d); err != nil {
+		log.Printf("Error executing %s template: %s", t.Name(), err)
+		return ""
+	}
+	return strings.TrimSpace(buf.String())
+}
+
+// slashMessage renders the in-channel response to a slash command.
+func (r *renderer) slashMessage(userID string, meta *InstaMeta) *slack.Msg {
+	d := newRenderData(userID, meta)
+
+	blocks := make([]slack.Block, 0, 5)
+
+	headline := r.execute(r.headline, d)
+	if headline != "" {
+		blocks = append(blocks, slack.NewSectionBlock(mrkdwnText(headline), nil, nil))
+	}
+
+	text := fallbackText(meta)
+	if headline != "" {
+		text = fmt.Sprintf("%s: %s", headline, text)
+	}
+
+	return &slack.Msg{
+		ResponseType: slack.ResponseTypeInChannel,
+		Text:         text,
+		Blocks: slack.Blocks{
+			BlockSet: append(blocks, r.blocks(d)...),
+		},
+	}
+}
+
+// unfurlBlocks renders the blocks for a link unfurl.
+func (r *renderer) unfurlBlocks(meta *InstaMeta) []slack.Block {
+	return r.blocks(newRenderData("", meta))
+}
+
+func (r *renderer) blocks(d *renderData) []slack.Block {
+	meta := d.Meta
+	blocks := make([]slack.Block, 0, len(r.fields))
+
+	for _, field := range r.fields {
+		switch field {
+		case RenderFieldProfile:
+			if meta.Username == "" {
+				continue
+			}
+
+			profile := fmt.Sprintf("*<https://www.instagram.com/%s/|@%s>*", meta.Username, escapeMrkdwn(meta.Username))
+
+			elements := make([]slack.MixedElement, 0, 2)
+			if meta.UserPicURL != "" {
+				elements = append(elements, slack.NewImageBlockElement(meta.UserPicURL, "@"+meta.Username))
+			}
+			elements = append(elements, mrkdwnText(profile))
+
+			blocks = append(blocks, slack.NewContextBlock("", elements...))
+
+		case RenderFieldCaption:
+			caption := meta.Caption
+			if caption == "" {
+				caption = meta.Title
+			}
+			if caption == "" {
+				continue
+			}
+
+			blocks = append(blocks, slack.NewSectionBlock(mrkdwnText(truncate(escapeMrkdwn(caption), maxSectionTextLen)), nil, nil))
+
+		case RenderFieldImage:
+			if meta.ImageURL == "" {
+				continue
+			}
+
+			blocks = append(blocks, imageBlock{
+				Type:     slack.MBTImage,
+				ImageURL: meta.ImageURL,
+				AltText:  imageAltText(meta),
+			})
+
+		case RenderFieldFooter:
+			footer := r.execute(r.footer, d)
+			if footer == "" {
+				continue
+			}
+
+			blocks = append(blocks, slack.NewContextBlock("", mrkdwnText(footer)))
+		}
+	}
+
+	return blocks
+}
+
+func imageAltText(meta *InstaMeta) string {
+	alt := "Instagram post"
+	if meta.Username != "" {
+		alt = fmt.Sprintf("Instagram post by @%s", meta.Username)
+	}
+	if meta.Caption != "" {
+		alt = fmt.Sprintf("%s: %s", alt, meta.Caption)
+	}
+	return truncate(alt, maxAltTextLen)
+}
+
+// fallbackText is the plain notification text for a rendered post.
+func fallbackText(meta *InstaMeta) string {
+	if meta.Username == "" {
+		return meta.URL
+	}
+	return fmt.Sprintf("%s by @%s", meta.URL, meta.Username)
+}
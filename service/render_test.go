@@ -0,0 +1,124 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files")
+
+func checkGolden(t *testing.T, name string, v interface{}) {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		t.Fatalf("marshal: %s", err)
+	}
+	actual := buf.Bytes()
+
+	path := filepath.Join("testdata", "golden", name+".json")
+
+	if *updateGolden {
+		if err := ioutil.WriteFile(path, actual, 0644); err != nil {
+			t.Fatalf("write golden: %s", err)
+		}
+		return
+	}
+
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read golden: %s", err)
+	}
+
+	if !bytes.Equal(expected, actual) {
+		t.Errorf("output differs from %s (run with -update to accept)\nexpected:\n%s\nactual:\n%s", path, expected, actual)
+	}
+}
+
+func testMeta() *InstaMeta {
+	return &InstaMeta{
+		Username:   "someone",
+		UserPicURL: "https://example.com/pic.jpg",
+		Title:      "Someone on Instagram: “A day at the beach”",
+		URL:        "https://www.instagram.com/p/CA1lPepDJXO/",
+		ImageURL:   "https://example.com/image.jpg",
+		PartCount:  1,
+		Caption:    "A day at the <beach> & sea",
+		TakenAt:    time.Date(2020, 5, 30, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestRender(t *testing.T) {
+	carousel := testMeta()
+	carousel.PartCount = 3
+	carousel.PartIndex = 1
+	carousel.ImageIsVideo = true
+
+	bare := &InstaMeta{
+		Title:     "Instagram",
+		URL:       "https://www.instagram.com/p/CA1lPepDJXO/",
+		ImageURL:  "https://example.com/image.jpg",
+		PartCount: 1,
+	}
+
+	custom := mustNewRenderer(&RenderConfig{
+		Headline: `{{.Meta.Username | escape}} via <@{{.UserID}}>`,
+		Footer:   `<{{.Meta.URL}}|{{if .Meta.ImageIsVideo}}Watch{{else}}Open{{end}}>`,
+		Fields:   []string{RenderFieldImage, RenderFieldFooter},
+	})
+
+	t.Run("slash default", func(t *testing.T) {
+		checkGolden(t, "slash_default", defaultRenderer.slashMessage("U123", testMeta()))
+	})
+
+	t.Run("slash carousel video", func(t *testing.T) {
+		checkGolden(t, "slash_carousel_video", defaultRenderer.slashMessage("U123", carousel))
+	})
+
+	t.Run("slash custom", func(t *testing.T) {
+		checkGolden(t, "slash_custom", custom.slashMessage("U123", carousel))
+	})
+
+	t.Run("unfurl default", func(t *testing.T) {
+		checkGolden(t, "unfurl_default", defaultRenderer.unfurlBlocks(testMeta()))
+	})
+
+	t.Run("unfurl bare", func(t *testing.T) {
+		checkGolden(t, "unfurl_bare", defaultRenderer.unfurlBlocks(bare))
+	})
+
+	t.Run("unfurl custom", func(t *testing.T) {
+		checkGolden(t, "unfurl_custom", custom.unfurlBlocks(testMeta()))
+	})
+}
+
+func TestRenderConfig(t *testing.T) {
+	if _, err := newRenderer(&RenderConfig{Fields: []string{"bogus"}}); err == nil {
+		t.Errorf("expected error for unknown field")
+	}
+
+	if _, err := newRenderer(&RenderConfig{Headline: "{{.Nope"}); err == nil {
+		t.Errorf("expected error for bad template")
+	}
+
+	cfg, err := NewConfigFromJSON([]byte(`{"queue_url":"q","slack_teams":{"tkn":{"name":"t","oauth_token":"xoxb","render":{"fields":["image"]}}}}`))
+	if err != nil {
+		t.Fatalf("config: %s", err)
+	}
+
+	if r := cfg.rendererForTeam(cfg.TeamByRequestToken("tkn")); len(r.fields) != 1 {
+		t.Errorf("expected team renderer, got fields %v", r.fields)
+	}
+
+	if r := cfg.rendererForTeam(nil); r != defaultRenderer {
+		t.Errorf("expected default renderer")
+	}
+}
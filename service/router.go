@@ -0,0 +1,291 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+type lambdaEventKind string
+
+const (
+	eventKindUnknown       lambdaEventKind = ""
+	eventKindAPIGatewayV1  lambdaEventKind = "apigateway_v1"
+	eventKindAPIGatewayV2  lambdaEventKind = "apigateway_v2"
+	eventKindFunctionURL   lambdaEventKind = "function_url"
+	eventKindALB           lambdaEventKind = "alb"
+	eventKindSQS           lambdaEventKind = "sqs"
+	eventKindScheduled     lambdaEventKind = "scheduled"
+	eventKindCloudWatchEvt lambdaEventKind = "cloudwatch_event"
+)
+
+// lambdaEventProbe holds just enough of every supported payload to tell
+// them apart.
+type lambdaEventProbe struct {
+	Version        string `json:"version"`
+	HTTPMethod     string `json:"httpMethod"`
+	RawPath        string `json:"rawPath"`
+	RequestContext struct {
+		ELB        json.RawMessage `json:"elb"`
+		HTTP       json.RawMessage `json:"http"`
+		DomainName string          `json:"domainName"`
+	} `json:"requestContext"`
+	Records []struct {
+		EventSource string `json:"eventSource"`
+	} `json:"Records"`
+	Source     string `json:"source"`
+	DetailType string `json:"detail-type"`
+}
+
+func detectLambdaEvent(payload []byte) lambdaEventKind {
+	p := &lambdaEventProbe{}
+	if err := json.Unmarshal(payload, p); err != nil {
+		return eventKindUnknown
+	}
+
+	switch {
+	case len(p.Records) > 0 && p.Records[0].EventSource == "aws:sqs":
+		return eventKindSQS
+	case p.RequestContext.ELB != nil:
+		return eventKindALB
+	case p.Version == "2.0" && p.RequestContext.HTTP != nil:
+		if strings.Contains(p.RequestContext.DomainName, ".lambda-url.") {
+			return eventKindFunctionURL
+		}
+		return eventKindAPIGatewayV2
+	case p.HTTPMethod != "":
+		return eventKindAPIGatewayV1
+	case p.Source == "aws.events" && p.DetailType == "Scheduled Event":
+		return eventKindScheduled
+	case p.Source != "" && p.DetailType != "":
+		return eventKindCloudWatchEvt
+	}
+
+	return eventKindUnknown
+}
+
+// httpRequest is an inbound request from any of the http integrations.
+type httpRequest struct {
+	Method  string
+	Path    string
+	Headers map[string]string
+	Query   map[string]string
+	Body    string
+}
+
+func newHTTPRequest(method, path string, headers, query map[string]string, body string, b64 bool) (*httpRequest, error) {
+	if b64 {
+		dec, err := base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			return nil, fmt.Errorf("base64 decoding body: %w", err)
+		}
+		body = string(dec)
+	}
+
+	return &httpRequest{
+		Method:  method,
+		Path:    path,
+		Headers: headers,
+		Query:   query,
+		Body:    body,
+	}, nil
+}
+
+func (h *handler) Invoke(ctx context.Context, payload []byte) ([]byte, error) {
+	defer h.flushMetrics()
+
+	kind := detectLambdaEvent(payload)
+
+	switch kind {
+	case eventKindAPIGatewayV1:
+		evt := &events.APIGatewayProxyRequest{}
+		if err := json.Unmarshal(payload, evt); err != nil {
+			return nil, err
+		}
+
+		req, err := newHTTPRequest(evt.HTTPMethod, evt.Path, evt.Headers, evt.QueryStringParameters, evt.Body, evt.IsBase64Encoded)
+		if err != nil {
+			return json.Marshal(NewSlackTextResponse(400, "Bad api request body (base64 decode fail)"))
+		}
+
+		resp, err := h.handleHTTPRequest(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(resp)
+
+	case eventKindAPIGatewayV2, eventKindFunctionURL:
+		evt := &events.APIGatewayV2HTTPRequest{}
+		if err := json.Unmarshal(payload, evt); err != nil {
+			return nil, err
+		}
+
+		req, err := newHTTPRequest(evt.RequestContext.HTTP.Method, evt.RawPath, evt.Headers, evt.QueryStringParameters, evt.Body, evt.IsBase64Encoded)
+		if err != nil {
+			return json.Marshal(toV2Response(NewSlackTextResponse(400, "Bad api request body (base64 decode fail)")))
+		}
+
+		resp, err := h.handleHTTPRequest(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(toV2Response(resp))
+
+	case eventKindALB:
+		evt := &events.ALBTargetGroupRequest{}
+		if err := json.Unmarshal(payload, evt); err != nil {
+			return nil, err
+		}
+
+		multi := evt.MultiValueHeaders != nil
+
+		req, err := newHTTPRequest(evt.HTTPMethod, evt.Path, albHeaders(evt), albQuery(evt), evt.Body, evt.IsBase64Encoded)
+		if err != nil {
+			return json.Marshal(toALBResponse(NewSlackTextResponse(400, "Bad api request body (base64 decode fail)"), multi))
+		}
+
+		resp, err := h.handleHTTPRequest(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(toALBResponse(resp, multi))
+
+	case eventKindSQS:
+		evt := &events.SQSEvent{}
+		if err := json.Unmarshal(payload, evt); err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(h.handleSQSEvent(ctx, evt))
+
+	case eventKindScheduled:
+		evt := &events.CloudWatchEvent{}
+		if err := json.Unmarshal(payload, evt); err != nil {
+			return nil, err
+		}
+
+		return nil, h.handleScheduledEvent(ctx, evt)
+
+	case eventKindCloudWatchEvt:
+		// Some other EventBridge rule points at us; there's nothing to do,
+		// and failing would only make Lambda retry it.
+		evt := &events.CloudWatchEvent{}
+		json.Unmarshal(payload, evt)
+		log.Printf("Ignoring %q event %s from %s", evt.DetailType, evt.ID, evt.Source)
+		return nil, nil
+	}
+
+	log.Printf("Unsupported lambda payload (%s)", kind)
+	return nil, fmt.Errorf("Unsupported lambda payload")
+}
+
+func (h *handler) handleHTTPRequest(ctx context.Context, req *httpRequest) (*events.APIGatewayProxyResponse, error) {
+	resp, err := h.handleAPIRequest(ctx, req)
+	if err != nil {
+		log.Printf("Error from api request handler: %s", err)
+	}
+	return resp, err
+}
+
+func (h *handler) handleScheduledEvent(ctx context.Context, evt *events.CloudWatchEvent) error {
+	log.Printf("Scheduled event %s from %v", evt.ID, evt.Resources)
+
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline.Add(-sqsDeadlineMargin))
+		defer cancel()
+	}
+
+	now := evt.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	h.runDueJobs(ctx, now)
+	return nil
+}
+
+// albHeaders flattens multi value headers, which ALB sends instead of
+// Headers when they're enabled on the target group.
+func albHeaders(evt *events.ALBTargetGroupRequest) map[string]string {
+	if evt.MultiValueHeaders == nil {
+		return evt.Headers
+	}
+
+	headers := make(map[string]string, len(evt.MultiValueHeaders))
+	for k, v := range evt.MultiValueHeaders {
+		if len(v) > 0 {
+			headers[k] = v[0]
+		}
+	}
+	return headers
+}
+
+// albQuery flattens and decodes query parameters, which ALB passes on
+// still url encoded.
+func albQuery(evt *events.ALBTargetGroupRequest) map[string]string {
+	query := make(map[string]string)
+
+	add := func(k, v string) {
+		if uk, err := url.QueryUnescape(k); err == nil {
+			k = uk
+		}
+		if uv, err := url.QueryUnescape(v); err == nil {
+			v = uv
+		}
+		if _, ok := query[k]; !ok {
+			query[k] = v
+		}
+	}
+
+	for k, vs := range evt.MultiValueQueryStringParameters {
+		if len(vs) > 0 {
+			add(k, vs[0])
+		}
+	}
+	for k, v := range evt.QueryStringParameters {
+		add(k, v)
+	}
+
+	return query
+}
+
+func toV2Response(resp *events.APIGatewayProxyResponse) *events.APIGatewayV2HTTPResponse {
+	return &events.APIGatewayV2HTTPResponse{
+		StatusCode:      resp.StatusCode,
+		Headers:         resp.Headers,
+		Body:            resp.Body,
+		IsBase64Encoded: resp.IsBase64Encoded,
+	}
+}
+
+func toALBResponse(resp *events.APIGatewayProxyResponse, multi bool) *events.ALBTargetGroupResponse {
+	alb := &events.ALBTargetGroupResponse{
+		StatusCode:        resp.StatusCode,
+		StatusDescription: fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode)),
+		Body:              resp.Body,
+		IsBase64Encoded:   resp.IsBase64Encoded,
+	}
+
+	if multi {
+		alb.MultiValueHeaders = make(map[string][]string, len(resp.Headers))
+		for k, v := range resp.Headers {
+			alb.MultiValueHeaders[k] = []string{v}
+		}
+	} else {
+		alb.Headers = resp.Headers
+	}
+
+	return alb
+}
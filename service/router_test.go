@@ -0,0 +1,67 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+const (
+	testV1Event    = `{"resource":"/","path":"/slack/install","httpMethod":"GET","headers":{},"requestContext":{"stage":"prod"}}`
+	testV2Event    = `{"version":"2.0","rawPath":"/slack/install","headers":{},"requestContext":{"domainName":"abc.execute-api.us-east-1.amazonaws.com","http":{"method":"GET","path":"/slack/install"}}}`
+	testURLEvent   = `{"version":"2.0","rawPath":"/other","headers":{},"requestContext":{"domainName":"abc.lambda-url.us-east-1.on.aws","http":{"method":"GET","path":"/other"}}}`
+	testALBEvent   = `{"requestContext":{"elb":{"targetGroupArn":"arn:aws:elasticloadbalancing:tg"}},"httpMethod":"GET","path":"/other","queryStringParameters":{"q":"a%20b"},"multiValueHeaders":{"accept":["*/*"]},"body":"","isBase64Encoded":false}`
+	testSQSEvent   = `{"Records":[{"messageId":"m1","eventSource":"aws:sqs","body":"{}"}]}`
+	testCronEvent  = `{"version":"0","id":"e1","detail-type":"Scheduled Event","source":"aws.events","resources":["arn:aws:events:rule/x"],"detail":{}}`
+	testOtherEvent = `{"version":"0","id":"e2","detail-type":"EC2 Instance State-change Notification","source":"aws.ec2","detail":{}}`
+)
+
+func TestDetectLambdaEvent(t *testing.T) {
+	for payload, want := range map[string]lambdaEventKind{
+		testV1Event:    eventKindAPIGatewayV1,
+		testV2Event:    eventKindAPIGatewayV2,
+		testURLEvent:   eventKindFunctionURL,
+		testALBEvent:   eventKindALB,
+		testSQSEvent:   eventKindSQS,
+		testCronEvent:  eventKindScheduled,
+		testOtherEvent: eventKindCloudWatchEvt,
+		`{"foo":1}`:    eventKindUnknown,
+	} {
+		if got := detectLambdaEvent([]byte(payload)); got != want {
+			t.Errorf("expected %q, got %q for %s", want, got, payload)
+		}
+	}
+}
+
+func TestInvokeResponseShapes(t *testing.T) {
+	h := &handler{config: &Config{}, store: newMemoryStore()}
+	ctx := context.Background()
+
+	out, err := h.Invoke(ctx, []byte(testURLEvent))
+	if err != nil {
+		t.Fatalf("function url: %s", err)
+	}
+	v2 := map[string]interface{}{}
+	json.Unmarshal(out, &v2)
+	if v2["statusCode"] != float64(404) || v2["multiValueHeaders"] != nil {
+		t.Errorf("unexpected function url response %s", out)
+	}
+
+	out, err = h.Invoke(ctx, []byte(testALBEvent))
+	if err != nil {
+		t.Fatalf("alb: %s", err)
+	}
+	alb := map[string]interface{}{}
+	json.Unmarshal(out, &alb)
+	if alb["statusDescription"] != "404 Not Found" || alb["multiValueHeaders"] == nil {
+		t.Errorf("unexpected alb response %s", out)
+	}
+
+	if out, err := h.Invoke(ctx, []byte(testOtherEvent)); err != nil || out != nil {
+		t.Errorf("expected other events to be ignored, got %s %v", out, err)
+	}
+
+	if _, err := h.Invoke(ctx, []byte(`{"foo":1}`)); err == nil {
+		t.Errorf("expected unknown payload to fail")
+	}
+}
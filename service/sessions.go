@@ -0,0 +1,234 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultSessionName     = "default"
+	defaultSessionCooldown = 6 * time.Hour
+)
+
+var errLoginWall = errors.New("instagram login wall")
+
+// SessionConfig is one logged in Instagram session.
+type SessionConfig struct {
+	Name    string `json:"name"`
+	Cookies string `json:"cookies"`
+}
+
+// sessions returns the configured session pool, falling back to the
+// single global cookie string for older configs.
+func (c *Config) sessions() []*SessionConfig {
+	if len(c.Sessions) > 0 {
+		return c.Sessions
+	}
+	return []*SessionConfig{{Name: defaultSessionName, Cookies: c.CookieString}}
+}
+
+func (c *Config) sessionCooldown() time.Duration {
+	if c.SessionCooldown.Duration > 0 {
+		return c.SessionCooldown.Duration
+	}
+	return defaultSessionCooldown
+}
+
+// minHealthySessions is the pool size below which admins are alerted.
+func (c *Config) minHealthySessions() int {
+	if c.MinHealthySessions > 0 {
+		return c.MinHealthySessions
+	}
+	if n := len(c.sessions()); n < 2 {
+		return n
+	}
+	return 2
+}
+
+func sessionUnhealthyKey(name string) string {
+	return "session/" + name + "/unhealthy"
+}
+
+func sessionCookiesKey(name string) string {
+	return "session/" + name + "/cookies"
+}
+
+const sessionLowAlertKey = "session/low_alert"
+
+// session is a pool entry with its current cookies, which may have been
+// refreshed by Instagram since the config was written.
+type session struct {
+	name    string
+	cookies string
+}
+
+func (h *handler) loadSession(ctx context.Context, sc *SessionConfig) *session {
+	s := &session{name: sc.Name, cookies: sc.Cookies}
+
+	if data, err := h.store.Get(ctx, sessionCookiesKey(sc.Name)); err == nil {
+		s.cookies = string(data)
+	} else if err != errNotFound {
+		log.Printf("Error loading cookies for session %s: %s", sc.Name, err)
+	}
+
+	return s
+}
+
+func (h *handler) sessionHealthy(ctx context.Context, name string) bool {
+	_, err := h.store.Get(ctx, sessionUnhealthyKey(name))
+	return err != nil
+}
+
+// nextSessions returns the pool in round robin order, healthy sessions
+// first, so a fetch can move on when one hits the login wall.
+func (h *handler) nextSessions(ctx context.Context) []*session {
+	start := atomic.AddUint32(&h.sessionNext, 1) - 1
+	return h.sessionsInOrder(ctx, start)
+}
+
+// sessionsInOrder returns the pool starting from the session the next
+// fetch would use, healthy sessions first, without moving the round robin
+// on.
+func (h *handler) sessionsInOrder(ctx context.Context, next uint32) []*session {
+	pool := h.config.sessions()
+	start := int(next % uint32(len(pool)))
+
+	healthy := make([]*session, 0, len(pool))
+	var unhealthy []*session
+
+	for i := range pool {
+		sc := pool[(start+i)%len(pool)]
+		if h.sessionHealthy(ctx, sc.Name) {
+			healthy = append(healthy, h.loadSession(ctx, sc))
+		} else {
+			unhealthy = append(unhealthy, h.loadSession(ctx, sc))
+		}
+	}
+
+	if len(healthy) == 0 {
+		log.Printf("No healthy instagram sessions, trying unhealthy ones")
+	}
+
+	return append(healthy, unhealthy...)
+}
+
+// markSessionUnhealthy takes a session out of rotation for the cooldown,
+// and alerts if that leaves the pool running low.
+func (h *handler) markSessionUnhealthy(ctx context.Context, name string, reason error) {
+	log.Printf("Marking instagram session %s unhealthy: %s", name, reason)
+
+	cooldown := h.config.sessionCooldown()
+	if err := h.store.Put(ctx, sessionUnhealthyKey(name), []byte(reason.Error()), cooldown); err != nil {
+		log.Printf("Error marking session %s unhealthy: %s", name, err)
+	}
+
+	pool := h.config.sessions()
+	healthy := 0
+	for _, sc := range pool {
+		if h.sessionHealthy(ctx, sc.Name) {
+			healthy++
+		}
+	}
+
+	if healthy >= h.config.minHealthySessions() {
+		return
+	}
+
+	// one alert per cooldown, not one per failed fetch
+	if n, err := h.store.Add(ctx, sessionLowAlertKey, 1, cooldown); err != nil || n != 1 {
+		return
+	}
+
+	text := fmt.Sprintf(":warning: Instagram session pool is low: %d of %d healthy, %s just hit the login wall", healthy, len(pool), name)
+	if err := h.alertAdmin(ctx, text); err != nil {
+		log.Printf("Error alerting on session pool: %s", err)
+	}
+}
+
+func (h *handler) markSessionHealthy(ctx context.Context, name string) {
+	if h.sessionHealthy(ctx, name) {
+		return
+	}
+
+	log.Printf("Instagram session %s is healthy again", name)
+	if err := h.store.Delete(ctx, sessionUnhealthyKey(name)); err != nil {
+		log.Printf("Error marking session %s healthy: %s", name, err)
+	}
+}
+
+// updateSessionCookies merges any cookies set by a response into the
+// session and stores them if anything changed.
+func (h *handler) updateSessionCookies(ctx context.Context, s *session, resp *http.Response) {
+	set := resp.Cookies()
+	if len(set) == 0 {
+		return
+	}
+
+	updated := mergeCookies(s.cookies, set)
+	if updated == s.cookies {
+		return
+	}
+
+	s.cookies = updated
+	if err := h.store.Put(ctx, sessionCookiesKey(s.name), []byte(updated), 0); err != nil {
+		log.Printf("Error storing cookies for session %s: %s", s.name, err)
+	}
+}
+
+// mergeCookies applies Set-Cookie values to a Cookie header string,
+// keeping the existing order and dropping deleted cookies.
+func mergeCookies(header string, set []*http.Cookie) string {
+	var names []string
+	values := make(map[string]string)
+
+	for _, part := range strings.Split(header, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if _, ok := values[kv[0]]; !ok {
+			names = append(names, kv[0])
+		}
+		values[kv[0]] = kv[1]
+	}
+
+	for _, c := range set {
+		if c.MaxAge < 0 || c.Value == "" || c.Value == "deleted" {
+			delete(values, c.Name)
+			continue
+		}
+		if _, ok := values[c.Name]; !ok {
+			names = append(names, c.Name)
+		}
+		values[c.Name] = c.Value
+	}
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		if v, ok := values[name]; ok {
+			parts = append(parts, name+"="+v)
+		}
+	}
+
+	return strings.Join(parts, "; ")
+}
+
+// isLoginWall reports whether instagram answered with its login page
+// instead of the post.
+func isLoginWall(resp *http.Response, page *pageData) bool {
+	if resp.Request != nil && strings.HasPrefix(resp.Request.URL.Path, "/accounts/login") {
+		return true
+	}
+
+	return page.LoginWall
+}
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestMergeCookies(t *testing.T) {
+	got := mergeCookies("sessionid=abc; csrftoken=old; mid=m", []*http.Cookie{
+		{Name: "csrftoken", Value: "new"},
+		{Name: "mid", Value: "deleted"},
+		{Name: "rur", Value: "r1"},
+	})
+
+	if want := "sessionid=abc; csrftoken=new; rur=r1"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestSessionRotation(t *testing.T) {
+	ctx := context.Background()
+
+	h := &handler{
+		config: &Config{
+			Sessions: []*SessionConfig{{Name: "a", Cookies: "sessionid=a"}, {Name: "b", Cookies: "sessionid=b"}, {Name: "c", Cookies: "sessionid=c"}},
+		},
+		store: newMemoryStore(),
+	}
+
+	if first, second := h.nextSessions(ctx)[0].name, h.nextSessions(ctx)[0].name; first == second {
+		t.Errorf("expected round robin, got %s twice", first)
+	}
+
+	h.markSessionUnhealthy(ctx, "a", errLoginWall)
+	h.markSessionUnhealthy(ctx, "b", errLoginWall)
+
+	order := h.nextSessions(ctx)
+	if len(order) != 3 || order[0].name != "c" {
+		t.Errorf("expected healthy session first, got %s", order[0].name)
+	}
+
+	if _, err := h.store.Get(ctx, sessionLowAlertKey); err != nil {
+		t.Errorf("expected low pool alert to be recorded: %s", err)
+	}
+
+	h.markSessionHealthy(ctx, "a")
+	if !h.sessionHealthy(ctx, "a") || h.sessionHealthy(ctx, "b") {
+		t.Errorf("unexpected health after recovery")
+	}
+
+	legacy := &Config{CookieString: "sessionid=x"}
+	if s := legacy.sessions(); len(s) != 1 || s[0].Cookies != "sessionid=x" {
+		t.Errorf("expected cookies to become the default session, got %#v", s)
+	}
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const defaultSlackAPIURL = "https://slack.com/api/"
+
+type slackAPIResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// slackRetryableErrors are api errors worth trying again later.
+var slackRetryableErrors = map[string]bool{
+	"ratelimited":         true,
+	"internal_error":      true,
+	"fatal_error":         true,
+	"service_unavailable": true,
+	"request_timeout":     true,
+}
+
+// slackError is an ok:false response from a slack api method.
+type slackError struct {
+	method string
+	code   string
+}
+
+func (e *slackError) Error() string {
+	return fmt.Sprintf("%s: %s", e.method, e.code)
+}
+
+func (r *slackAPIResponse) err(method string) error {
+	if r.OK {
+		return nil
+	}
+
+	err := &slackError{method: method, code: r.Error}
+	if !slackRetryableErrors[r.Error] {
+		return permanent(err)
+	}
+
+	return err
+}
+
+type oauthV2Response struct {
+	slackAPIResponse
+	AccessToken         string            `json:"access_token"`
+	RefreshToken        string            `json:"refresh_token,omitempty"`
+	ExpiresIn           int64             `json:"expires_in,omitempty"`
+	TokenType           string            `json:"token_type"`
+	Scope               string            `json:"scope"`
+	BotUserID           string            `json:"bot_user_id"`
+	AppID               string            `json:"app_id"`
+	Team                *oauthV2Reference `json:"team"`
+	Enterprise          *oauthV2Reference `json:"enterprise"`
+	IsEnterpriseInstall bool              `json:"is_enterprise_install"`
+}
+
+type oauthV2Reference struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type authTestResponse struct {
+	slackAPIResponse
+	Team   string `json:"team"`
+	TeamID string `json:"team_id"`
+	User   string `json:"user"`
+	UserID string `json:"user_id"`
+	BotID  string `json:"bot_id,omitempty"`
+}
+
+// slackAPIURL is the base url for slack web api methods, ending in a slash.
+func (h *handler) slackAPIURL() string {
+	if h.config.SlackAPIURL != "" {
+		return strings.TrimSuffix(h.config.SlackAPIURL, "/") + "/"
+	}
+	return defaultSlackAPIURL
+}
+
+// callSlackForm posts a form encoded request to a slack web api method and
+// decodes the response into out, which must embed slackAPIResponse.
+func (h *handler) callSlackForm(ctx context.Context, method string, values url.Values, out interface{}) (err error) {
+	defer h.observeSlackCall(method, time.Now(), &err)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.slackAPIURL()+method, strings.NewReader(values.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+
+	clients, err := h.http()
+	if err != nil {
+		return err
+	}
+
+	resp, err := clients.slack.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		return statusError(method, resp.StatusCode)
+	}
+
+	status := &slackAPIResponse{}
+	if err := json.Unmarshal(data, status); err != nil {
+		return fmt.Errorf("%s: %w", method, err)
+	}
+	if err := status.err(method); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, out)
+}
@@ -3,7 +3,9 @@ package service
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
+	"strconv"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
@@ -14,9 +16,19 @@ import (
 const (
 	SQSMessageTypeSlash  = "slash_command"
 	SQSMessageTypeUnfurl = "unfurl_event"
+
+	defaultMaxReceiveCount = 5
+
+	defaultSlashFreshness  = 5 * time.Minute
+	defaultUnfurlFreshness = 30 * time.Minute
+
+	// slack accepts posts to a response_url for this long
+	responseURLLifetime = 30 * time.Minute
 )
 
 type SQSSlackMessage struct {
+	Version          int           `json:"version"`
+	TraceID          string        `json:"trace_id,omitempty"`
 	RequestTimestamp int64         `json:"request_timestamp"`
 	Type             string        `json:"type"`
 	SlashMessage     *SlashMessage `json:"slash_message,omitempty"`
@@ -27,55 +39,236 @@ type SlashMessage struct {
 	InstagramURL  string `json:"instagram_url"`
 	SelectedIndex int    `json:"selected_index,omitempty"`
 	ResponseURL   string `json:"response_url"`
-	UserID        string `jsoin:"user_id"`
+	UserID        string `json:"user_id"`
+	ChannelID     string `json:"channel_id,omitempty"`
+	Token         string `json:"token,omitempty"`
+	TeamID        string `json:"team_id,omitempty"`
+	EnterpriseID  string `json:"enterprise_id,omitempty"`
+}
+
+func (m *SlashMessage) teamKey() teamKey {
+	return teamKey{EnterpriseID: m.EnterpriseID, TeamID: m.TeamID}
 }
 
 func (h *handler) enqueueMessage(ctx context.Context, ssMsg *SQSSlackMessage) error {
+	ssMsg.Version = SQSMessageVersion
+	if ssMsg.TraceID == "" {
+		ssMsg.TraceID = newTraceID()
+	}
+
 	data, err := json.Marshal(ssMsg)
 	if err != nil {
 		return err
 	}
 
 	input := &sqs.SendMessageInput{
-		QueueUrl:    aws.String(h.config.QueueURL),
-		MessageBody: aws.String(string(data)),
+		QueueUrl:          aws.String(h.config.QueueURL),
+		MessageBody:       aws.String(string(data)),
+		MessageAttributes: ssMsg.messageAttributes(),
 	}
 
 	log.Printf("Enqueueing message %#v", ssMsg)
 
-	_, err = h.sqs.SendMessageWithContext(ctx, input)
+	start := time.Now()
+	_, err = h.queue.SendMessageWithContext(ctx, input)
+	h.metrics.observe(metricQueueSend, time.Since(start).Seconds(), ssMsg.Type, resultLabel(err))
+
 	return err
 }
 
-func (h *handler) handleSQSMessage(ctx context.Context, sqsMsg events.SQSMessage) {
-	log.Printf("Handling sqs message..")
+// orderingKey groups messages that must be handled in order: those for
+// the same channel.
+func (m *SQSSlackMessage) orderingKey() string {
+	switch {
+	case m.SlashMessage != nil && m.SlashMessage.ChannelID != "":
+		return m.SlashMessage.teamKey().String() + "/" + m.SlashMessage.ChannelID
+	case m.UnfurlEvent != nil && m.UnfurlEvent.Event.Channel != "":
+		return m.UnfurlEvent.installation().String() + "/" + m.UnfurlEvent.Event.Channel
+	}
+	return ""
+}
 
-	ssMsg := &SQSSlackMessage{}
-	err := json.Unmarshal([]byte(sqsMsg.Body), ssMsg)
-	if err != nil {
-		log.Printf("Error unmarshaling sqs message body (%s) %s", sqsMsg.Body, err)
-	} else {
-
-		log.Printf("Got a message from SQS with type %s, created %ds ago", ssMsg.Type, time.Now().Unix()-ssMsg.RequestTimestamp)
-
-		if time.Unix(ssMsg.RequestTimestamp, 0).Add(maxLag).Before(time.Now()) {
-			log.Printf("SQS message too old %#v", ssMsg)
-		} else {
-			switch ssMsg.Type {
-			case SQSMessageTypeSlash:
-				h.processSQSSlashMessage(ctx, ssMsg)
-			case SQSMessageTypeUnfurl:
-				h.processSQSUnfurlMessage(ctx, ssMsg)
-			}
+// groupSQSRecords splits a batch into groups of record indexes sharing an
+// ordering key, keeping batch order within and between groups.
+func groupSQSRecords(records []events.SQSMessage) [][]int {
+	groups := make([][]int, 0, len(records))
+	byKey := make(map[string]int)
+
+	for i, r := range records {
+		key := ""
+		if ssMsg, err := decodeSQSMessage([]byte(r.Body)); err == nil {
+			key = ssMsg.orderingKey()
 		}
+
+		if key == "" {
+			groups = append(groups, []int{i})
+			continue
+		}
+
+		if g, ok := byKey[key]; ok {
+			groups[g] = append(groups[g], i)
+			continue
+		}
+
+		byKey[key] = len(groups)
+		groups = append(groups, []int{i})
 	}
 
-	// delete
-	input := &sqs.DeleteMessageInput{
-		QueueUrl:      aws.String(h.config.QueueURL),
-		ReceiptHandle: aws.String(sqsMsg.ReceiptHandle),
+	return groups
+}
+
+// SQSEventResponse reports the records of a batch that should be retried.
+// It needs ReportBatchItemFailures enabled on the event source mapping.
+type SQSEventResponse struct {
+	BatchItemFailures []SQSBatchItemFailure `json:"batchItemFailures"`
+}
+
+type SQSBatchItemFailure struct {
+	ItemIdentifier string `json:"itemIdentifier"`
+}
+
+func (h *handler) maxReceiveCount() int {
+	if h.config.MaxReceiveCount > 0 {
+		return h.config.MaxReceiveCount
+	}
+	return defaultMaxReceiveCount
+}
+
+// handleSQSMessage processes one record, returning an error only when it
+// should be retried. Messages that fail permanently, or too many times,
+// go to the dead letter queue.
+func (h *handler) handleSQSMessage(ctx context.Context, sqsMsg events.SQSMessage) error {
+	log.Printf("Handling sqs message %s..", sqsMsg.MessageId)
+
+	attempts, _ := strconv.Atoi(sqsMsg.Attributes["ApproximateReceiveCount"])
+
+	ssMsg, err := decodeSQSMessage([]byte(sqsMsg.Body))
+	if err != nil && !isPermanent(err) && attempts < h.maxReceiveCount() {
+		log.Printf("Can't handle sqs message %s yet (attempt %d), will retry: %s", sqsMsg.MessageId, attempts, err)
+		return err
+	} else if err != nil {
+		log.Printf("Error decoding sqs message body (%s) %s", sqsMsg.Body, err)
+		return h.deadLetter(ctx, sqsMsg, err)
 	}
-	if _, err = h.sqs.DeleteMessageWithContext(ctx, input); err != nil {
-		log.Printf("Error deleting sqs message %s: %s", sqsMsg.ReceiptHandle, err)
+
+	log.Printf("Got a message from SQS with type %s (v%d, trace %s), created %ds ago", ssMsg.Type, ssMsg.Version, ssMsg.TraceID, time.Now().Unix()-ssMsg.RequestTimestamp)
+
+	age := time.Since(time.Unix(ssMsg.RequestTimestamp, 0))
+	h.metrics.observe(metricQueueLag, age.Seconds(), ssMsg.Type)
+
+	if age > h.freshness(ssMsg.Type) {
+		log.Printf("SQS message too old (%s) %#v", age, ssMsg)
+		h.notifyStale(ctx, ssMsg, age)
+		return nil
 	}
+
+	switch ssMsg.Type {
+	case SQSMessageTypeSlash:
+		err = h.processSQSSlashMessage(ctx, ssMsg)
+	case SQSMessageTypeUnfurl:
+		err = h.processSQSUnfurlMessage(ctx, ssMsg)
+	}
+
+	if err == nil {
+		return nil
+	}
+
+	if ctx.Err() != nil {
+		log.Printf("Interrupted processing message %s, will retry: %s", sqsMsg.MessageId, err)
+		return err
+	}
+
+	if !isPermanent(err) && attempts < h.maxReceiveCount() {
+		log.Printf("Error processing message %s (attempt %d), will retry: %s", sqsMsg.MessageId, attempts, err)
+		return err
+	}
+
+	log.Printf("Giving up on message %s after %d attempts: %s", sqsMsg.MessageId, attempts, err)
+
+	// the user is told once the message is safely parked, so a failed
+	// send doesn't tell them again on every redelivery
+	if err := h.deadLetter(ctx, sqsMsg, err); err != nil {
+		return err
+	}
+	h.notifyFailure(ctx, ssMsg, err)
+
+	return nil
+}
+
+// freshness is how old a message of the given type can be and still be
+// worth processing.
+func (h *handler) freshness(msgType string) time.Duration {
+	f := h.config.Freshness
+
+	switch msgType {
+	case SQSMessageTypeSlash:
+		if f != nil && f.Slash.Duration > 0 {
+			return f.Slash.Duration
+		}
+		return defaultSlashFreshness
+	case SQSMessageTypeUnfurl:
+		if f != nil && f.Unfurl.Duration > 0 {
+			return f.Unfurl.Duration
+		}
+		return defaultUnfurlFreshness
+	}
+
+	return defaultSlashFreshness
+}
+
+// notifyStale tells the user when their slash command sat in the queue too
+// long to be worth answering, while the response_url still works.
+func (h *handler) notifyStale(ctx context.Context, ssMsg *SQSSlackMessage, age time.Duration) {
+	if ssMsg.Type != SQSMessageTypeSlash || ssMsg.SlashMessage == nil || age >= responseURLLifetime {
+		return
+	}
+
+	text := fmt.Sprintf("Sorry, it took too long to get to %s, please try again.", ssMsg.SlashMessage.InstagramURL)
+	if err := h.postSlashResponse(ctx, ssMsg.SlashMessage.ResponseURL, simpleEphemeralMessage(text)); err != nil {
+		log.Printf("Error sending stale response: %s", err)
+	}
+}
+
+// notifyFailure lets the user know when we've given up on their request.
+func (h *handler) notifyFailure(ctx context.Context, ssMsg *SQSSlackMessage, reason error) {
+	if ssMsg.Type != SQSMessageTypeSlash || ssMsg.SlashMessage == nil {
+		return
+	}
+
+	if err := h.postSlashResponse(ctx, ssMsg.SlashMessage.ResponseURL, simpleEphemeralMessage(friendlyError(reason))); err != nil {
+		log.Printf("Error sending failure response: %s", err)
+	}
+}
+
+// deadLetter moves a message we've given up on to the dead letter queue.
+// Without one, or when the send fails, it returns an error so the record
+// goes back to SQS, to be redelivered or moved by the queue's own redrive
+// policy rather than lost.
+func (h *handler) deadLetter(ctx context.Context, sqsMsg events.SQSMessage, reason error) error {
+	if h.config.DeadLetterQueueURL == "" {
+		log.Printf("Returning message %s to the queue, no dead letter queue configured", sqsMsg.MessageId)
+		return fmt.Errorf("no dead letter queue for message %s: %w", sqsMsg.MessageId, reason)
+	}
+
+	input := &sqs.SendMessageInput{
+		QueueUrl:    aws.String(h.config.DeadLetterQueueURL),
+		MessageBody: aws.String(sqsMsg.Body),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"error": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(reason.Error()),
+			},
+			"source_message_id": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(sqsMsg.MessageId),
+			},
+		},
+	}
+
+	if _, err := h.queue.SendMessageWithContext(ctx, input); err != nil {
+		log.Printf("Error sending message %s to dead letter queue: %s", sqsMsg.MessageId, err)
+		return fmt.Errorf("dead lettering message %s: %w", sqsMsg.MessageId, err)
+	}
+
+	return nil
 }
@@ -0,0 +1,183 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// SQSMessageVersion is the envelope version written by this build.
+//
+//	1: unversioned; SlashMessage.UserID was serialized as "UserID"
+//	2: version, trace_id and message attributes added
+const SQSMessageVersion = 2
+
+const (
+	sqsAttrType    = "type"
+	sqsAttrVersion = "version"
+	sqsAttrTraceID = "trace_id"
+	sqsAttrTeam    = "team"
+)
+
+// sqsMigrations upgrade a raw message body from the version they're keyed
+// by to the next one.
+var sqsMigrations = map[int]func(map[string]json.RawMessage) error{
+	1: migrateSQSMessageV1,
+}
+
+func newTraceID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(buf)
+}
+
+// team returns the installation the message is for, if known.
+func (m *SQSSlackMessage) team() string {
+	switch {
+	case m.SlashMessage != nil:
+		return m.SlashMessage.teamKey().String()
+	case m.UnfurlEvent != nil:
+		return m.UnfurlEvent.installation().String()
+	}
+	return ""
+}
+
+func (m *SQSSlackMessage) messageAttributes() map[string]*sqs.MessageAttributeValue {
+	attrs := map[string]*sqs.MessageAttributeValue{
+		sqsAttrType: {
+			DataType:    aws.String("String"),
+			StringValue: aws.String(m.Type),
+		},
+		sqsAttrVersion: {
+			DataType:    aws.String("Number"),
+			StringValue: aws.String(strconv.Itoa(m.Version)),
+		},
+	}
+
+	if m.TraceID != "" {
+		attrs[sqsAttrTraceID] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(m.TraceID),
+		}
+	}
+
+	if t := m.team(); t != "" {
+		attrs[sqsAttrTeam] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(t),
+		}
+	}
+
+	return attrs
+}
+
+// sqsEnvelopeFields are the top level keys of a current SQSSlackMessage.
+var sqsEnvelopeFields = map[string]bool{
+	"version":           true,
+	"trace_id":          true,
+	"request_timestamp": true,
+	"type":              true,
+	"slash_message":     true,
+	"unfurl_message":    true,
+}
+
+// decodeSQSMessage reads a queued message body, migrating older versions.
+// Malformed messages and unknown types are permanent errors; a version
+// newer than ours is not, so that during a rolling deploy the message goes
+// back to the queue for an updated worker.
+func decodeSQSMessage(body []byte) (*SQSSlackMessage, error) {
+	raw := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, permanent(err)
+	}
+
+	version := 1
+	if v, ok := raw["version"]; ok {
+		if err := json.Unmarshal(v, &version); err != nil {
+			return nil, permanent(fmt.Errorf("bad version: %w", err))
+		}
+	}
+
+	if version > SQSMessageVersion {
+		return nil, fmt.Errorf("message version %d is newer than supported version %d", version, SQSMessageVersion)
+	}
+
+	if version < SQSMessageVersion {
+		for v := version; v < SQSMessageVersion; v++ {
+			migrate, ok := sqsMigrations[v]
+			if !ok {
+				return nil, permanent(fmt.Errorf("no migration from message version %d", v))
+			}
+			if err := migrate(raw); err != nil {
+				return nil, permanent(fmt.Errorf("migrating from version %d: %w", v, err))
+			}
+		}
+
+		raw["version"] = json.RawMessage(strconv.Itoa(SQSMessageVersion))
+
+		var err error
+		if body, err = json.Marshal(raw); err != nil {
+			return nil, permanent(err)
+		}
+	}
+
+	for key := range raw {
+		if !sqsEnvelopeFields[key] {
+			return nil, permanent(fmt.Errorf("unknown field %q in message", key))
+		}
+	}
+
+	// Only the envelope is strict; the payloads come from Slack and may
+	// grow fields we don't know about.
+	ssMsg := &SQSSlackMessage{}
+	if err := json.Unmarshal(body, ssMsg); err != nil {
+		return nil, permanent(err)
+	}
+
+	switch ssMsg.Type {
+	case SQSMessageTypeSlash:
+		if ssMsg.SlashMessage == nil {
+			return nil, permanent(fmt.Errorf("%s message without slash_message", ssMsg.Type))
+		}
+	case SQSMessageTypeUnfurl:
+		if ssMsg.UnfurlEvent == nil {
+			return nil, permanent(fmt.Errorf("%s message without unfurl_message", ssMsg.Type))
+		}
+	default:
+		return nil, permanent(fmt.Errorf("unknown message type %q", ssMsg.Type))
+	}
+
+	return ssMsg, nil
+}
+
+func migrateSQSMessageV1(raw map[string]json.RawMessage) error {
+	sm, ok := raw["slash_message"]
+	if !ok || string(sm) == "null" {
+		return nil
+	}
+
+	slash := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(sm, &slash); err != nil {
+		return err
+	}
+
+	if uid, ok := slash["UserID"]; ok {
+		slash["user_id"] = uid
+		delete(slash, "UserID")
+	}
+
+	data, err := json.Marshal(slash)
+	if err != nil {
+		return err
+	}
+
+	raw["slash_message"] = data
+	return nil
+}
@@ -0,0 +1,103 @@
+package service
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDecodeSQSMessage(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		in := &SQSSlackMessage{
+			Version:          SQSMessageVersion,
+			TraceID:          "abc",
+			RequestTimestamp: 1,
+			Type:             SQSMessageTypeSlash,
+			SlashMessage:     &SlashMessage{UserID: "U1", InstagramURL: "https://www.instagram.com/p/x/"},
+		}
+
+		data, err := json.Marshal(in)
+		if err != nil {
+			t.Fatalf("marshal: %s", err)
+		}
+
+		out, err := decodeSQSMessage(data)
+		if err != nil {
+			t.Fatalf("decode: %s", err)
+		}
+
+		if out.SlashMessage.UserID != "U1" || out.TraceID != "abc" {
+			t.Errorf("unexpected message %#v", out.SlashMessage)
+		}
+	})
+
+	t.Run("migrate v1", func(t *testing.T) {
+		v1 := `{"request_timestamp":1,"type":"slash_command","slash_message":{"instagram_url":"https://www.instagram.com/p/x/","response_url":"https://r","UserID":"U1"}}`
+
+		out, err := decodeSQSMessage([]byte(v1))
+		if err != nil {
+			t.Fatalf("decode: %s", err)
+		}
+
+		if out.Version != SQSMessageVersion {
+			t.Errorf("expected version %d, got %d", SQSMessageVersion, out.Version)
+		}
+
+		if out.SlashMessage.UserID != "U1" {
+			t.Errorf("expected migrated user id, got %q", out.SlashMessage.UserID)
+		}
+	})
+
+	t.Run("newer version", func(t *testing.T) {
+		_, err := decodeSQSMessage([]byte(`{"version":99,"type":"slash_command"}`))
+		if err == nil || isPermanent(err) {
+			t.Errorf("expected retryable error, got %v", err)
+		}
+	})
+
+	t.Run("unknown type", func(t *testing.T) {
+		_, err := decodeSQSMessage([]byte(`{"version":2,"type":"mystery"}`))
+		if err == nil || !isPermanent(err) {
+			t.Errorf("expected permanent error, got %v", err)
+		}
+	})
+
+	t.Run("unknown field", func(t *testing.T) {
+		_, err := decodeSQSMessage([]byte(`{"version":2,"type":"slash_command","slash_message":{},"surprise":1}`))
+		if err == nil || !isPermanent(err) {
+			t.Errorf("expected permanent error, got %v", err)
+		}
+	})
+
+	t.Run("unknown payload field", func(t *testing.T) {
+		out, err := decodeSQSMessage([]byte(`{"version":2,"type":"unfurl_event","unfurl_message":{"team_id":"T1","event":{"channel":"C1","surprise":1},"surprise":1}}`))
+		if err != nil {
+			t.Fatalf("decode: %s", err)
+		}
+
+		if out.UnfurlEvent.TeamID != "T1" {
+			t.Errorf("unexpected message %#v", out.UnfurlEvent)
+		}
+	})
+}
+
+func TestSQSMessageAttributes(t *testing.T) {
+	m := &SQSSlackMessage{
+		Version:     SQSMessageVersion,
+		TraceID:     "abc",
+		Type:        SQSMessageTypeUnfurl,
+		UnfurlEvent: &UnfurlEvent{TeamID: "T1", EnterpriseID: "E1"},
+	}
+
+	attrs := m.messageAttributes()
+
+	for k, expected := range map[string]string{
+		sqsAttrType:    SQSMessageTypeUnfurl,
+		sqsAttrVersion: "2",
+		sqsAttrTraceID: "abc",
+		sqsAttrTeam:    "E1/T1",
+	} {
+		if a, ok := attrs[k]; !ok || *a.StringValue != expected {
+			t.Errorf("attribute %s: expected %s, got %#v", k, expected, a)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestPermanentErrors(t *testing.T) {
+	if !isPermanent(statusError("x", 404)) {
+		t.Errorf("404 should be permanent")
+	}
+
+	for _, code := range []int{408, 429, 500, 503} {
+		if isPermanent(statusError("x", code)) {
+			t.Errorf("%d should be retryable", code)
+		}
+	}
+
+	wrapped := fmt.Errorf("fetching: %w", permanent(errors.New("gone")))
+	if !isPermanent(wrapped) {
+		t.Errorf("wrapped permanent error should be permanent")
+	}
+
+	if (&slackAPIResponse{Error: "ratelimited"}).err("m") == nil || isPermanent((&slackAPIResponse{Error: "ratelimited"}).err("m")) {
+		t.Errorf("ratelimited should be a retryable error")
+	}
+
+	if !isPermanent((&slackAPIResponse{Error: "cannot_unfurl_url"}).err("m")) {
+		t.Errorf("cannot_unfurl_url should be permanent")
+	}
+}
+
+func TestSQSBatchPoisonMessages(t *testing.T) {
+	queue := NewMemoryQueue()
+	h := &handler{
+		config: &Config{DeadLetterQueueURL: "dlq"},
+		queue:  queue,
+		store:  newMemoryStore(),
+	}
+
+	evt := &events.SQSEvent{
+		Records: []events.SQSMessage{
+			{MessageId: "1", Body: "not json"},
+			{MessageId: "2", Body: `{"type":"mystery","request_timestamp":9999999999}`},
+		},
+	}
+
+	resp := h.handleSQSEvent(context.Background(), evt)
+	if len(resp.BatchItemFailures) != 0 || queue.Len("dlq") != 2 {
+		t.Errorf("poison messages should be dead lettered, got %#v and %d dead letters", resp.BatchItemFailures, queue.Len("dlq"))
+	}
+
+	// with nowhere to put them, they go back to the queue
+	h.config.DeadLetterQueueURL = ""
+	resp = h.handleSQSEvent(context.Background(), evt)
+	if len(resp.BatchItemFailures) != 2 {
+		t.Errorf("expected poison messages to be returned without a dead letter queue, got %#v", resp.BatchItemFailures)
+	}
+}
+
+func TestSQSNewerVersionGivesUp(t *testing.T) {
+	queue := NewMemoryQueue()
+	h := &handler{
+		config: &Config{DeadLetterQueueURL: "dlq", MaxReceiveCount: 3},
+		queue:  queue,
+		store:  newMemoryStore(),
+	}
+
+	record := func(attempts string) events.SQSMessage {
+		return events.SQSMessage{
+			MessageId:  "1",
+			Body:       `{"version":99,"type":"slash_command"}`,
+			Attributes: map[string]string{"ApproximateReceiveCount": attempts},
+		}
+	}
+
+	if err := h.handleSQSMessage(context.Background(), record("1")); err == nil {
+		t.Errorf("expected a newer message to be retried")
+	}
+
+	if err := h.handleSQSMessage(context.Background(), record("3")); err != nil {
+		t.Errorf("expected to give up on the last attempt, got %s", err)
+	}
+
+	if n := queue.Len("dlq"); n != 1 {
+		t.Errorf("expected the message to be dead lettered, got %d", n)
+	}
+}
+
+func TestGroupSQSRecords(t *testing.T) {
+	records := []events.SQSMessage{
+		{Body: `{"type":"unfurl_event","unfurl_message":{"team_id":"T1","event":{"channel":"C1"}}}`},
+		{Body: `{"type":"slash_command","slash_message":{"team_id":"T1","channel_id":"C2"}}`},
+		{Body: `{"type":"unfurl_event","unfurl_message":{"team_id":"T1","event":{"channel":"C1"}}}`},
+		{Body: "not json"},
+		{Body: `{"type":"slash_command","slash_message":{"team_id":"T1","channel_id":"C1"}}`},
+	}
+
+	groups := groupSQSRecords(records)
+
+	expected := "[[0 2 4] [1] [3]]"
+	if actual := fmt.Sprint(groups); actual != expected {
+		t.Errorf("expected groups %s, got %s", expected, actual)
+	}
+}
+
+func TestSQSBatchOutOfTime(t *testing.T) {
+	h := &handler{
+		config: &Config{},
+		store:  newMemoryStore(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sqsDeadlineMargin/2)
+	defer cancel()
+
+	evt := &events.SQSEvent{
+		Records: []events.SQSMessage{
+			{MessageId: "1", Body: "not json"},
+			{MessageId: "2", Body: "not json"},
+		},
+	}
+
+	resp := h.handleSQSEvent(ctx, evt)
+	if len(resp.BatchItemFailures) != 2 {
+		t.Errorf("expected everything to be returned to the queue, got %#v", resp.BatchItemFailures)
+	}
+}
+
+func TestFreshness(t *testing.T) {
+	h := &handler{config: &Config{}}
+
+	if f := h.freshness(SQSMessageTypeSlash); f != defaultSlashFreshness {
+		t.Errorf("unexpected default slash freshness %s", f)
+	}
+
+	cfg, err := NewConfigFromJSON([]byte(`{"queue_url":"q","slack_teams":{"tkn":{"name":"t","oauth_token":"xoxb"}},"freshness":{"slash_command":"2m","unfurl_event":3600}}`))
+	if err != nil {
+		t.Fatalf("config: %s", err)
+	}
+
+	h.config = cfg
+
+	if f := h.freshness(SQSMessageTypeSlash); f != 2*time.Minute {
+		t.Errorf("unexpected slash freshness %s", f)
+	}
+
+	if f := h.freshness(SQSMessageTypeUnfurl); f != time.Hour {
+		t.Errorf("unexpected unfurl freshness %s", f)
+	}
+}
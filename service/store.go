@@ -0,0 +1,142 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+)
+
+const (
+	StoreTypeMemory   = "memory"
+	StoreTypeFile     = "file"
+	StoreTypeDynamoDB = "dynamodb"
+)
+
+var errNotFound = errors.New("not found")
+
+// Store is a small key/value store for state that has to outlive a single
+// invocation, such as installed team tokens. Values with a ttl > 0 expire.
+type Store interface {
+	// Get returns errNotFound for missing or expired keys.
+	Get(ctx context.Context, key string) ([]byte, error)
+	Put(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, key string) error
+	// Add atomically adds delta to the counter at key and returns the new
+	// value. A missing or expired counter starts from zero with the given
+	// ttl; an existing one keeps its expiry.
+	Add(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error)
+}
+
+type StoreConfig struct {
+	Type string `json:"type"`
+
+	// file
+	Path string `json:"path,omitempty"`
+
+	// dynamodb
+	Table    string `json:"table,omitempty"`
+	Region   string `json:"region,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+// NewStore builds the store described by cfg. A nil config gives an
+// in-memory store, which only lives as long as the process.
+func NewStore(cfg *StoreConfig, awsSession client.ConfigProvider) (Store, error) {
+	if cfg == nil {
+		return newMemoryStore(), nil
+	}
+
+	switch cfg.Type {
+	case "", StoreTypeMemory:
+		return newMemoryStore(), nil
+	case StoreTypeFile:
+		return newFileStore(cfg.Path)
+	case StoreTypeDynamoDB:
+		return newDynamoStore(awsSession, cfg.Table, cfg.Region, cfg.Endpoint)
+	}
+
+	return nil, fmt.Errorf("unknown store type %q", cfg.Type)
+}
+
+type storeEntry struct {
+	Value   []byte `json:"value"`
+	Expires int64  `json:"expires,omitempty"`
+}
+
+func newStoreEntry(value []byte, ttl time.Duration) *storeEntry {
+	e := &storeEntry{Value: value}
+	if ttl > 0 {
+		e.Expires = time.Now().Add(ttl).Unix()
+	}
+	return e
+}
+
+func (e *storeEntry) expired(now time.Time) bool {
+	return e.Expires > 0 && e.Expires <= now.Unix()
+}
+
+// add applies a counter increment to e, which may be nil or expired, and
+// returns the updated entry.
+func (e *storeEntry) add(delta int64, ttl time.Duration) (*storeEntry, int64) {
+	if e == nil || e.expired(time.Now()) {
+		return newStoreEntry([]byte(strconv.FormatInt(delta, 10)), ttl), delta
+	}
+
+	n, _ := strconv.ParseInt(string(e.Value), 10, 64)
+	n += delta
+
+	return &storeEntry{Value: []byte(strconv.FormatInt(n, 10)), Expires: e.Expires}, n
+}
+
+type memoryStore struct {
+	mu      sync.Mutex
+	entries map[string]*storeEntry
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		entries: make(map[string]*storeEntry),
+	}
+}
+
+func (s *memoryStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok || e.expired(time.Now()) {
+		return nil, errNotFound
+	}
+
+	return e.Value, nil
+}
+
+func (s *memoryStore) Put(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[key] = newStoreEntry(value, ttl)
+	return nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+	return nil
+}
+
+func (s *memoryStore) Add(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, n := s.entries[key].add(delta, ttl)
+	s.entries[key] = e
+	return n, nil
+}
@@ -0,0 +1,178 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+const (
+	dynamoKeyAttr     = "key"
+	dynamoValueAttr   = "value"
+	dynamoCountAttr   = "count"
+	dynamoExpiresAttr = "expires_at"
+
+	dynamoAddAttempts = 3
+)
+
+// dynamoStore keeps entries in a DynamoDB (or compatible) table with a
+// string hash key named "key". Enable TTL on "expires_at" to have expired
+// entries cleaned up; they are ignored on read either way.
+type dynamoStore struct {
+	db    dynamodbiface.DynamoDBAPI
+	table string
+}
+
+func newDynamoStore(p client.ConfigProvider, table, region, endpoint string) (*dynamoStore, error) {
+	if p == nil {
+		return nil, fmt.Errorf("dynamodb store needs an aws session")
+	}
+	if table == "" {
+		return nil, fmt.Errorf("dynamodb store needs a table")
+	}
+
+	cfg := aws.NewConfig()
+	if region != "" {
+		cfg = cfg.WithRegion(region)
+	}
+	if endpoint != "" {
+		cfg = cfg.WithEndpoint(endpoint)
+	}
+
+	return &dynamoStore{
+		db:    dynamodb.New(p, cfg),
+		table: table,
+	}, nil
+}
+
+func (s *dynamoStore) key(key string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		dynamoKeyAttr: {S: aws.String(key)},
+	}
+}
+
+func (s *dynamoStore) Get(ctx context.Context, key string) ([]byte, error) {
+	out, err := s.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            s.key(key),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if out.Item == nil || (out.Item[dynamoValueAttr] == nil && out.Item[dynamoCountAttr] == nil) {
+		return nil, errNotFound
+	}
+
+	if exp := out.Item[dynamoExpiresAttr]; exp != nil && exp.N != nil {
+		n, _ := strconv.ParseInt(*exp.N, 10, 64)
+		if (&storeEntry{Expires: n}).expired(time.Now()) {
+			return nil, errNotFound
+		}
+	}
+
+	if c := out.Item[dynamoCountAttr]; c != nil && c.N != nil {
+		return []byte(*c.N), nil
+	}
+
+	return out.Item[dynamoValueAttr].B, nil
+}
+
+func (s *dynamoStore) Put(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	item := s.key(key)
+	item[dynamoValueAttr] = &dynamodb.AttributeValue{B: value}
+
+	if e := newStoreEntry(nil, ttl); e.Expires > 0 {
+		item[dynamoExpiresAttr] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(e.Expires, 10))}
+	}
+
+	_, err := s.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item:      item,
+	})
+	return err
+}
+
+func (s *dynamoStore) Delete(ctx context.Context, key string) error {
+	_, err := s.db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.table),
+		Key:       s.key(key),
+	})
+	return err
+}
+
+// Add keeps counters in a numeric attribute so they can be updated in
+// place. An expired counter is replaced rather than added to.
+func (s *dynamoStore) Add(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	now := aws.String(strconv.FormatInt(time.Now().Unix(), 10))
+	d := aws.String(strconv.FormatInt(delta, 10))
+
+	for i := 0; i < dynamoAddAttempts; i++ {
+		update := &dynamodb.UpdateItemInput{
+			TableName:           aws.String(s.table),
+			Key:                 s.key(key),
+			UpdateExpression:    aws.String("ADD #c :d"),
+			ConditionExpression: aws.String("attribute_not_exists(#e) OR #e > :now"),
+			ExpressionAttributeNames: map[string]*string{
+				"#c": aws.String(dynamoCountAttr),
+				"#e": aws.String(dynamoExpiresAttr),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":d":   {N: d},
+				":now": {N: now},
+			},
+			ReturnValues: aws.String(dynamodb.ReturnValueUpdatedNew),
+		}
+
+		if e := newStoreEntry(nil, ttl); e.Expires > 0 {
+			update.UpdateExpression = aws.String("ADD #c :d SET #e = if_not_exists(#e, :exp)")
+			update.ExpressionAttributeValues[":exp"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(e.Expires, 10))}
+		}
+
+		out, err := s.db.UpdateItemWithContext(ctx, update)
+		if err == nil {
+			return strconv.ParseInt(aws.StringValue(out.Attributes[dynamoCountAttr].N), 10, 64)
+		}
+		if !isConditionalCheckFailed(err) {
+			return 0, err
+		}
+
+		// expired, start it again unless someone else just did
+		item := s.key(key)
+		item[dynamoCountAttr] = &dynamodb.AttributeValue{N: d}
+		if e := newStoreEntry(nil, ttl); e.Expires > 0 {
+			item[dynamoExpiresAttr] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(e.Expires, 10))}
+		}
+
+		_, err = s.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+			TableName:                aws.String(s.table),
+			Item:                     item,
+			ConditionExpression:      aws.String("#e <= :now"),
+			ExpressionAttributeNames: map[string]*string{"#e": aws.String(dynamoExpiresAttr)},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":now": {N: now},
+			},
+		})
+		if err == nil {
+			return delta, nil
+		}
+		if !isConditionalCheckFailed(err) {
+			return 0, err
+		}
+	}
+
+	return 0, fmt.Errorf("add %s: too much contention", key)
+}
+
+func isConditionalCheckFailed(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
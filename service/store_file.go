@@ -0,0 +1,100 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// fileStore is a memoryStore that is written through to a JSON file after
+// every change. It suits a single long running process.
+type fileStore struct {
+	*memoryStore
+	path string
+}
+
+func newFileStore(path string) (*fileStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("file store needs a path")
+	}
+
+	s := &fileStore{
+		memoryStore: newMemoryStore(),
+		path:        path,
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &s.entries); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	return s, nil
+}
+
+func (s *fileStore) Put(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[key] = newStoreEntry(value, ttl)
+	return s.save()
+}
+
+func (s *fileStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+	return s.save()
+}
+
+func (s *fileStore) Add(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, n := s.entries[key].add(delta, ttl)
+	s.entries[key] = e
+	return n, s.save()
+}
+
+// save must be called with the lock held.
+func (s *fileStore) save() error {
+	now := time.Now()
+	for k, e := range s.entries {
+		if e.expired(now) {
+			delete(s.entries, k)
+		}
+	}
+
+	data, err := json.Marshal(s.entries)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,212 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+func testStore(t *testing.T, s Store) {
+	ctx := context.Background()
+
+	if _, err := s.Get(ctx, "missing"); err != errNotFound {
+		t.Errorf("expected errNotFound, got %v", err)
+	}
+
+	if err := s.Put(ctx, "a", []byte("1"), 0); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+
+	if v, err := s.Get(ctx, "a"); err != nil || string(v) != "1" {
+		t.Errorf("get: %q %v", v, err)
+	}
+
+	for i := int64(1); i <= 3; i++ {
+		if n, err := s.Add(ctx, "counter", 1, time.Hour); err != nil || n != i {
+			t.Errorf("add: expected %d, got %d %v", i, n, err)
+		}
+	}
+
+	if v, err := s.Get(ctx, "counter"); err != nil || string(v) != "3" {
+		t.Errorf("get counter: %q %v", v, err)
+	}
+
+	if err := s.Delete(ctx, "a"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+
+	if _, err := s.Get(ctx, "a"); err != errNotFound {
+		t.Errorf("expected deleted entry to be missing, got %v", err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := newMemoryStore()
+	testStore(t, s)
+
+	s.entries["expired"] = &storeEntry{Value: []byte("1"), Expires: time.Now().Add(-time.Second).Unix()}
+
+	if _, err := s.Get(context.Background(), "expired"); err != errNotFound {
+		t.Errorf("expected expired entry to be missing, got %v", err)
+	}
+
+	if n, err := s.Add(context.Background(), "expired", 5, time.Hour); err != nil || n != 5 {
+		t.Errorf("expected expired counter to restart, got %d %v", n, err)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "store.json")
+
+	s, err := newFileStore(path)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+
+	testStore(t, s)
+
+	if err := s.Put(context.Background(), "kept", []byte("yes"), time.Hour); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+
+	reopened, err := newFileStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %s", err)
+	}
+
+	if v, err := reopened.Get(context.Background(), "kept"); err != nil || string(v) != "yes" {
+		t.Errorf("get after reopen: %q %v", v, err)
+	}
+}
+
+// fakeDynamo is an in-memory table understanding just the requests
+// dynamoStore makes.
+type fakeDynamo struct {
+	dynamodbiface.DynamoDBAPI
+
+	mu    sync.Mutex
+	items map[string]map[string]*dynamodb.AttributeValue
+}
+
+func (f *fakeDynamo) itemKey(key map[string]*dynamodb.AttributeValue) string {
+	return aws.StringValue(key[dynamoKeyAttr].S)
+}
+
+func (f *fakeDynamo) conditionFailed() error {
+	return awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "condition failed", nil)
+}
+
+func attrInt(av *dynamodb.AttributeValue) int64 {
+	if av == nil || av.N == nil {
+		return 0
+	}
+	n, _ := strconv.ParseInt(*av.N, 10, 64)
+	return n
+}
+
+func (f *fakeDynamo) GetItemWithContext(ctx aws.Context, in *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &dynamodb.GetItemOutput{Item: f.items[f.itemKey(in.Key)]}, nil
+}
+
+func (f *fakeDynamo) PutItemWithContext(ctx aws.Context, in *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	k := f.itemKey(in.Item)
+	if in.ConditionExpression != nil {
+		// "#e <= :now"
+		old := f.items[k]
+		if old == nil || old[dynamoExpiresAttr] == nil || attrInt(old[dynamoExpiresAttr]) > attrInt(in.ExpressionAttributeValues[":now"]) {
+			return nil, f.conditionFailed()
+		}
+	}
+
+	f.items[k] = in.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeDynamo) DeleteItemWithContext(ctx aws.Context, in *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.items, f.itemKey(in.Key))
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func (f *fakeDynamo) UpdateItemWithContext(ctx aws.Context, in *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	k := f.itemKey(in.Key)
+	item := f.items[k]
+
+	// "attribute_not_exists(#e) OR #e > :now"
+	if item != nil && item[dynamoExpiresAttr] != nil && attrInt(item[dynamoExpiresAttr]) <= attrInt(in.ExpressionAttributeValues[":now"]) {
+		return nil, f.conditionFailed()
+	}
+
+	if item == nil {
+		item = map[string]*dynamodb.AttributeValue{dynamoKeyAttr: in.Key[dynamoKeyAttr]}
+		f.items[k] = item
+	}
+
+	n := attrInt(item[dynamoCountAttr]) + attrInt(in.ExpressionAttributeValues[":d"])
+	item[dynamoCountAttr] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(n, 10))}
+	if exp := in.ExpressionAttributeValues[":exp"]; exp != nil && item[dynamoExpiresAttr] == nil {
+		item[dynamoExpiresAttr] = exp
+	}
+
+	return &dynamodb.UpdateItemOutput{Attributes: map[string]*dynamodb.AttributeValue{dynamoCountAttr: item[dynamoCountAttr]}}, nil
+}
+
+func TestDynamoStore(t *testing.T) {
+	fake := &fakeDynamo{items: make(map[string]map[string]*dynamodb.AttributeValue)}
+	s := &dynamoStore{db: fake, table: "test"}
+	testStore(t, s)
+
+	ctx := context.Background()
+	past := &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(time.Now().Add(-time.Second).Unix(), 10))}
+
+	fake.items["expired"] = map[string]*dynamodb.AttributeValue{
+		dynamoKeyAttr:     {S: aws.String("expired")},
+		dynamoValueAttr:   {B: []byte("1")},
+		dynamoExpiresAttr: past,
+	}
+	if _, err := s.Get(ctx, "expired"); err != errNotFound {
+		t.Errorf("expected expired entry to be missing, got %v", err)
+	}
+
+	fake.items["old-counter"] = map[string]*dynamodb.AttributeValue{
+		dynamoKeyAttr:     {S: aws.String("old-counter")},
+		dynamoCountAttr:   {N: aws.String("7")},
+		dynamoExpiresAttr: past,
+	}
+	if n, err := s.Add(ctx, "old-counter", 2, time.Hour); err != nil || n != 2 {
+		t.Errorf("expected expired counter to restart, got %d %v", n, err)
+	}
+	if exp := attrInt(fake.items["old-counter"][dynamoExpiresAttr]); exp <= time.Now().Unix() {
+		t.Errorf("expected restarted counter to get a new expiry, got %d", exp)
+	}
+
+	if err := s.Put(ctx, "ttl", []byte("x"), time.Hour); err != nil || fake.items["ttl"][dynamoExpiresAttr] == nil {
+		t.Errorf("expected put with a ttl to set %s: %v", dynamoExpiresAttr, err)
+	}
+}
@@ -0,0 +1,130 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+)
+
+var errUnknownTeam = errors.New("unknown team")
+
+// teamKey identifies an installation. Workspace installs have both ids
+// (EnterpriseID only on Enterprise Grid); org-wide installs have just the
+// EnterpriseID. All per-team state is keyed by it.
+type teamKey struct {
+	EnterpriseID string
+	TeamID       string
+}
+
+func (k teamKey) String() string {
+	return fmt.Sprintf("%s/%s", k.EnterpriseID, k.TeamID)
+}
+
+func (k teamKey) empty() bool {
+	return k.EnterpriseID == "" && k.TeamID == ""
+}
+
+func (k teamKey) storeKey() string {
+	return "team/" + k.String()
+}
+
+// candidates lists the installations that could serve a request from this
+// team, most specific first: the workspace itself, then an org-wide
+// install for its enterprise.
+func (k teamKey) candidates() []teamKey {
+	keys := make([]teamKey, 0, 2)
+	if k.TeamID != "" {
+		keys = append(keys, k)
+	}
+	if k.EnterpriseID != "" {
+		keys = append(keys, teamKey{EnterpriseID: k.EnterpriseID})
+	}
+	return keys
+}
+
+func (t *TeamInfo) key() teamKey {
+	return teamKey{EnterpriseID: t.EnterpriseID, TeamID: t.ID}
+}
+
+func (h *handler) getStoredTeam(ctx context.Context, key teamKey) (*TeamInfo, error) {
+	data, err := h.store.Get(ctx, key.storeKey())
+	if err != nil {
+		return nil, err
+	}
+
+	team := &TeamInfo{}
+	if err := json.Unmarshal(data, team); err != nil {
+		return nil, err
+	}
+
+	if err := team.Render.compile(); err != nil {
+		log.Printf("Ignoring bad render config for team %s: %s", key, err)
+		team.Render = nil
+	}
+
+	return team, nil
+}
+
+func (h *handler) putStoredTeam(ctx context.Context, team *TeamInfo) error {
+	data, err := json.Marshal(team)
+	if err != nil {
+		return err
+	}
+
+	return h.store.Put(ctx, team.key().storeKey(), data, 0)
+}
+
+// teamDataKeys lists every store key holding state for a team: its token
+// and settings, and anything cached on its behalf. Per user quota counters
+// aren't listed; they expire within a minute.
+func teamDataKeys(key teamKey) []string {
+	return []string{
+		key.storeKey(),
+		tokenRefreshLockKey(key),
+		quotaTeamKey(key),
+	}
+}
+
+// purgeTeam forgets everything stored for a team.
+func (h *handler) purgeTeam(ctx context.Context, key teamKey) error {
+	if key.empty() {
+		return fmt.Errorf("no team to purge")
+	}
+
+	for _, k := range teamDataKeys(key) {
+		if err := h.store.Delete(ctx, k); err != nil {
+			return fmt.Errorf("deleting %s: %w", k, err)
+		}
+	}
+
+	log.Printf("Purged stored data for team %s", key)
+	return nil
+}
+
+// teamForRequest finds the installation a request was made for: statically
+// configured teams by their verification token, installed teams by key.
+// It returns nil when the request shouldn't be served.
+func (h *handler) teamForRequest(ctx context.Context, token string, key teamKey) *TeamInfo {
+	if team := h.config.TeamByRequestToken(token); team != nil {
+		return team
+	}
+
+	if !h.config.validRequestToken(token) {
+		return nil
+	}
+
+	for _, k := range key.candidates() {
+		team, err := h.getStoredTeam(ctx, k)
+		if err == nil {
+			return team
+		} else if err != errNotFound {
+			log.Printf("Error loading team %s: %s", k, err)
+			return nil
+		}
+	}
+
+	log.Printf("No installation for team %s", key)
+	return nil
+}
@@ -0,0 +1,198 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestUninstallPurgesTeam(t *testing.T) {
+	ctx := context.Background()
+
+	h := &handler{
+		config: &Config{VerificationToken: "vtkn"},
+		store:  newMemoryStore(),
+	}
+
+	if err := h.putStoredTeam(ctx, &TeamInfo{ID: "T1", Name: "team", OauthToken: "xoxb-1"}); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+
+	if team := h.teamForRequest(ctx, "vtkn", teamKey{TeamID: "T1"}); team == nil || team.OauthToken != "xoxb-1" {
+		t.Fatalf("expected stored team, got %#v", team)
+	}
+
+	if team := h.teamForRequest(ctx, "wrong", teamKey{TeamID: "T1"}); team != nil {
+		t.Errorf("expected bad token to be rejected")
+	}
+
+	body := `{"token":"vtkn","team_id":"T1","type":"event_callback","event_id":"Ev1","event":{"type":"app_uninstalled"}}`
+
+	resp, err := h.handleAPIJSONRequest(ctx, body, nil)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("unexpected response %#v %v", resp, err)
+	}
+
+	if team := h.teamForRequest(ctx, "vtkn", teamKey{TeamID: "T1"}); team != nil {
+		t.Errorf("expected team to be purged, got %#v", team)
+	}
+
+	// audit entry and dedup marker
+	if n := len(h.store.(*memoryStore).entries); n != 2 {
+		t.Errorf("expected just the audit entry and event id to remain, got %d entries", n)
+	}
+
+	resp, err = h.handleAPIJSONRequest(ctx, body, map[string]string{"X-Slack-Retry-Num": "1"})
+	if err != nil || resp.StatusCode != 200 || resp.Body != "Duplicate event" {
+		t.Errorf("expected retry to be skipped, got %#v %v", resp, err)
+	}
+}
+
+func TestBotTokenUsesRefreshedToken(t *testing.T) {
+	ctx := context.Background()
+
+	h := &handler{
+		config: &Config{},
+		store:  newMemoryStore(),
+	}
+
+	stale := &TeamInfo{ID: "T1", OauthToken: "xoxe-old", RefreshToken: "r1", TokenExpiresAt: time.Now().Add(time.Minute).Unix()}
+	fresh := &TeamInfo{ID: "T1", OauthToken: "xoxe-new", RefreshToken: "r2", TokenExpiresAt: time.Now().Add(12 * time.Hour).Unix()}
+
+	if tkn, err := h.botToken(ctx, fresh); err != nil || tkn != "xoxe-new" {
+		t.Errorf("expected unexpired token to be used as is, got %s %v", tkn, err)
+	}
+
+	// another worker has already refreshed and stored the token
+	if err := h.putStoredTeam(ctx, fresh); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+
+	if tkn, err := h.botToken(ctx, stale); err != nil || tkn != "xoxe-new" {
+		t.Errorf("expected stored token, got %s %v", tkn, err)
+	}
+
+	if stale.RefreshToken != "r2" {
+		t.Errorf("expected team to be updated, got refresh token %s", stale.RefreshToken)
+	}
+}
+
+func TestBotTokenRefreshIsPerTeam(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := &handler{
+		config: &Config{},
+		store:  newMemoryStore(),
+	}
+
+	soon := time.Now().Add(time.Minute).Unix()
+	slow := &TeamInfo{ID: "T1", OauthToken: "xoxe-1", RefreshToken: "r1", TokenExpiresAt: soon}
+	h.putStoredTeam(ctx, slow)
+	// another process is refreshing T1's token and taking its time
+	h.store.Add(ctx, tokenRefreshLockKey(slow.key()), 1, time.Minute)
+
+	waiting := make(chan struct{})
+	go func() {
+		defer close(waiting)
+		h.botToken(ctx, slow)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	other := &TeamInfo{ID: "T2", OauthToken: "xoxe-old", RefreshToken: "r2", TokenExpiresAt: soon}
+	h.putStoredTeam(ctx, &TeamInfo{ID: "T2", OauthToken: "xoxe-new", TokenExpiresAt: time.Now().Add(time.Hour).Unix()})
+
+	done := make(chan string)
+	go func() {
+		tkn, _ := h.botToken(ctx, other)
+		done <- tkn
+	}()
+
+	select {
+	case tkn := <-done:
+		if tkn != "xoxe-new" {
+			t.Errorf("expected T2's stored token, got %s", tkn)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("T2's token lookup waited on T1's refresh")
+	}
+
+	cancel()
+	<-waiting
+}
+
+func TestEnterpriseInstallLookup(t *testing.T) {
+	ctx := context.Background()
+
+	h := &handler{
+		config: &Config{VerificationToken: "vtkn"},
+		store:  newMemoryStore(),
+	}
+
+	if err := h.putStoredTeam(ctx, &TeamInfo{EnterpriseID: "E1", OauthToken: "xoxb-org"}); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if err := h.putStoredTeam(ctx, &TeamInfo{EnterpriseID: "E1", ID: "T2", OauthToken: "xoxb-t2"}); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+
+	if team := h.teamForRequest(ctx, "vtkn", teamKey{EnterpriseID: "E1", TeamID: "T1"}); team == nil || team.OauthToken != "xoxb-org" {
+		t.Errorf("expected org-wide install for T1, got %#v", team)
+	}
+
+	if team := h.teamForRequest(ctx, "vtkn", teamKey{EnterpriseID: "E1", TeamID: "T2"}); team == nil || team.OauthToken != "xoxb-t2" {
+		t.Errorf("expected workspace install for T2, got %#v", team)
+	}
+
+	// link posted from another organisation into a Slack Connect channel
+	evt := &UnfurlEvent{
+		TeamID:             "TOTHER",
+		EnterpriseID:       "EOTHER",
+		IsExtSharedChannel: true,
+		Authorizations: []EventAuthorization{
+			{EnterpriseID: "E1", TeamID: "T9", IsBot: true, IsEnterpriseInstall: true},
+		},
+	}
+
+	if key := evt.installation(); key != (teamKey{EnterpriseID: "E1"}) {
+		t.Errorf("unexpected installation %s", key)
+	}
+
+	if team := h.teamForRequest(ctx, "vtkn", evt.installation()); team == nil || team.OauthToken != "xoxb-org" {
+		t.Errorf("expected org-wide install for shared channel event, got %#v", team)
+	}
+}
+
+func TestTokensRevokedOnlyPurgesOwnBot(t *testing.T) {
+	ctx := context.Background()
+
+	h := &handler{
+		config: &Config{VerificationToken: "vtkn", Quotas: &QuotaConfig{TeamPerDay: 10}},
+		store:  newMemoryStore(),
+	}
+
+	if err := h.putStoredTeam(ctx, &TeamInfo{ID: "T1", OauthToken: "xoxb-1", BotUserID: "UBOT"}); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	h.checkQuota(ctx, teamKey{TeamID: "T1"}, "U1")
+
+	revoke := func(eventID, bot string) {
+		body := `{"token":"vtkn","team_id":"T1","type":"event_callback","event_id":"` + eventID + `","event":{"type":"tokens_revoked","tokens":{"bot":["` + bot + `"]}}}`
+		if resp, err := h.handleAPIJSONRequest(ctx, body, nil); err != nil || resp.StatusCode != 200 {
+			t.Fatalf("unexpected response %#v %v", resp, err)
+		}
+	}
+
+	revoke("Ev1", "UOTHER")
+	if team := h.teamForRequest(ctx, "vtkn", teamKey{TeamID: "T1"}); team == nil {
+		t.Fatalf("expected team to survive another bot's revocation")
+	}
+
+	revoke("Ev2", "UBOT")
+	if team := h.teamForRequest(ctx, "vtkn", teamKey{TeamID: "T1"}); team != nil {
+		t.Errorf("expected team to be purged")
+	}
+	if _, err := h.store.Get(ctx, quotaTeamKey(teamKey{TeamID: "T1"})); err != errNotFound {
+		t.Errorf("expected quota counter to be purged, got %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	tokenRefreshMargin   = 10 * time.Minute
+	tokenRefreshLockTTL  = 30 * time.Second
+	tokenRefreshWait     = 10 * time.Second
+	tokenRefreshPollTime = 500 * time.Millisecond
+)
+
+func tokenRefreshLockKey(key teamKey) string {
+	return "token_refresh/" + key.String()
+}
+
+// setToken copies the access token details from an oauth.v2.access response.
+func (t *TeamInfo) setToken(resp *oauthV2Response) {
+	t.OauthToken = resp.AccessToken
+
+	if resp.RefreshToken != "" {
+		t.RefreshToken = resp.RefreshToken
+	}
+
+	if resp.ExpiresIn > 0 {
+		t.TokenExpiresAt = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second).Unix()
+	} else {
+		t.TokenExpiresAt = 0
+	}
+}
+
+func (t *TeamInfo) tokenNeedsRefresh(now time.Time) bool {
+	return t.RefreshToken != "" && t.TokenExpiresAt > 0 && now.Add(tokenRefreshMargin).Unix() >= t.TokenExpiresAt
+}
+
+func (t *TeamInfo) tokenExpired(now time.Time) bool {
+	return t.TokenExpiresAt > 0 && now.Unix() >= t.TokenExpiresAt
+}
+
+// botToken returns a usable bot token for the team, refreshing it first if
+// it's about to expire. Refreshes of a team's token are serialized within
+// the process by its mutex in refreshLocks and across processes by a lock
+// entry in the store; whoever loses the race waits for the winner's token
+// to appear. Other teams aren't held up.
+func (h *handler) botToken(ctx context.Context, team *TeamInfo) (string, error) {
+	if !team.tokenNeedsRefresh(time.Now()) {
+		return team.OauthToken, nil
+	}
+
+	mu, _ := h.refreshLocks.LoadOrStore(team.key().String(), &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+
+	lockKey := tokenRefreshLockKey(team.key())
+	deadline := time.Now().Add(tokenRefreshWait)
+
+	for {
+		current, err := h.getStoredTeam(ctx, team.key())
+		if err != nil {
+			return "", fmt.Errorf("reloading team: %w", err)
+		}
+
+		if !current.tokenNeedsRefresh(time.Now()) {
+			*team = *current
+			return team.OauthToken, nil
+		}
+
+		n, err := h.store.Add(ctx, lockKey, 1, tokenRefreshLockTTL)
+		if err != nil {
+			return "", fmt.Errorf("taking refresh lock: %w", err)
+		}
+
+		if n == 1 {
+			defer func() {
+				if err := h.store.Delete(ctx, lockKey); err != nil {
+					log.Printf("Error releasing token refresh lock %s: %s", lockKey, err)
+				}
+			}()
+
+			if err := h.refreshToken(ctx, current); err != nil {
+				return "", err
+			}
+
+			*team = *current
+			return team.OauthToken, nil
+		}
+
+		if time.Now().After(deadline) {
+			if !current.tokenExpired(time.Now()) {
+				log.Printf("Gave up waiting for token refresh of %s, using current token", team.key())
+				return current.OauthToken, nil
+			}
+			return "", fmt.Errorf("timed out waiting for token refresh")
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(tokenRefreshPollTime):
+		}
+	}
+}
+
+func (h *handler) refreshToken(ctx context.Context, team *TeamInfo) error {
+	oc := h.config.OAuth
+	if oc == nil || oc.ClientID == "" {
+		return fmt.Errorf("token rotation needs oauth client credentials")
+	}
+
+	values := url.Values{
+		"client_id":     {oc.ClientID},
+		"client_secret": {oc.ClientSecret},
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {team.RefreshToken},
+	}
+
+	resp := &oauthV2Response{}
+	if err := h.callSlackForm(ctx, "oauth.v2.access", values, resp); err != nil {
+		return fmt.Errorf("refreshing token: %w", err)
+	}
+
+	team.setToken(resp)
+
+	if err := h.putStoredTeam(ctx, team); err != nil {
+		return fmt.Errorf("storing refreshed token: %w", err)
+	}
+
+	log.Printf("Refreshed bot token for team %s, expires %s", team.key(), time.Unix(team.TokenExpiresAt, 0))
+	return nil
+}
@@ -0,0 +1,194 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultUserAgent           = "slack-instagram (+https://github.com/yemble/slack-instagram)"
+	defaultMaxIdleConnsPerHost = 10
+)
+
+// HTTPConfig configures outbound http. Proxy URLs may be http, https or
+// socks5; Proxy applies to everything, InstagramProxies are rotated
+// through for instagram fetches only and take precedence there. Without
+// either, the usual HTTPS_PROXY environment variables apply.
+type HTTPConfig struct {
+	UserAgent        string   `json:"user_agent,omitempty"`
+	Proxy            string   `json:"proxy,omitempty"`
+	InstagramProxies []string `json:"instagram_proxies,omitempty"`
+
+	InstagramTimeout    Duration `json:"instagram_timeout,omitempty"`
+	SlackTimeout        Duration `json:"slack_timeout,omitempty"`
+	MaxIdleConnsPerHost int      `json:"max_idle_conns_per_host,omitempty"`
+}
+
+// httpClients are shared by every outbound request so connections are
+// reused, one client per destination.
+type httpClients struct {
+	insta *http.Client
+	slack *http.Client
+}
+
+// HandlerOption customises a handler built by NewHandler.
+type HandlerOption func(h *handler)
+
+// WithTransport sends all outbound http through rt, bypassing the proxy
+// settings. It's meant for tests and local development.
+func WithTransport(rt http.RoundTripper) HandlerOption {
+	return func(h *handler) {
+		h.transport = rt
+	}
+}
+
+// http returns the shared clients, built on first use. A bad http config
+// is caught when the config is loaded, but handlers can be built from
+// configs that weren't, so it's a permanent error here rather than a
+// panic.
+func (h *handler) http() (*httpClients, error) {
+	h.httpOnce.Do(func() {
+		h.clients, h.clientsErr = newHTTPClients(h.config.HTTP, h.transport)
+		if h.clientsErr != nil {
+			h.clientsErr = permanent(fmt.Errorf("http config: %w", h.clientsErr))
+		}
+	})
+	return h.clients, h.clientsErr
+}
+
+func newHTTPClients(cfg *HTTPConfig, rt http.RoundTripper) (*httpClients, error) {
+	if cfg == nil {
+		cfg = &HTTPConfig{}
+	}
+
+	ua := cfg.UserAgent
+	if ua == "" {
+		ua = defaultUserAgent
+	}
+
+	instaTimeout := externalTimeout
+	if cfg.InstagramTimeout.Duration > 0 {
+		instaTimeout = cfg.InstagramTimeout.Duration
+	}
+	slackTimeout := externalTimeout
+	if cfg.SlackTimeout.Duration > 0 {
+		slackTimeout = cfg.SlackTimeout.Duration
+	}
+
+	instaRT, slackRT := rt, rt
+	if rt == nil {
+		proxy, err := fixedProxy(cfg.Proxy)
+		if err != nil {
+			return nil, err
+		}
+
+		instaProxy := proxy
+		if len(cfg.InstagramProxies) > 0 {
+			if instaProxy, err = rotatingProxy(cfg.InstagramProxies); err != nil {
+				return nil, err
+			}
+		}
+
+		instaRT = newTransport(instaProxy, cfg.MaxIdleConnsPerHost)
+		slackRT = newTransport(proxy, cfg.MaxIdleConnsPerHost)
+	}
+
+	return &httpClients{
+		insta: &http.Client{
+			Timeout:   instaTimeout,
+			Transport: &userAgentTransport{userAgent: ua, next: instaRT},
+		},
+		slack: &http.Client{
+			Timeout:   slackTimeout,
+			Transport: &userAgentTransport{userAgent: ua, next: slackRT},
+		},
+	}, nil
+}
+
+func newTransport(proxy func(*http.Request) (*url.URL, error), maxIdlePerHost int) *http.Transport {
+	if maxIdlePerHost <= 0 {
+		maxIdlePerHost = defaultMaxIdleConnsPerHost
+	}
+
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   maxIdlePerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+func parseProxyURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %q: %w", s, err)
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5":
+		return u, nil
+	}
+
+	return nil, fmt.Errorf("proxy %q: unsupported scheme %q", s, u.Scheme)
+}
+
+func fixedProxy(s string) (func(*http.Request) (*url.URL, error), error) {
+	if s == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	u, err := parseProxyURL(s)
+	if err != nil {
+		return nil, err
+	}
+	return http.ProxyURL(u), nil
+}
+
+// rotatingProxy uses each proxy in turn, so instagram sees requests
+// spread over several egress addresses.
+func rotatingProxy(list []string) (func(*http.Request) (*url.URL, error), error) {
+	proxies := make([]*url.URL, 0, len(list))
+	for _, s := range list {
+		u, err := parseProxyURL(s)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, u)
+	}
+
+	var next uint32
+	return func(*http.Request) (*url.URL, error) {
+		i := atomic.AddUint32(&next, 1) - 1
+		return proxies[int(i)%len(proxies)], nil
+	}, nil
+}
+
+// userAgentTransport sets our User-Agent on requests that don't have one.
+type userAgentTransport struct {
+	userAgent string
+	next      http.RoundTripper
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return next.RoundTrip(req)
+}
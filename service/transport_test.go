@@ -0,0 +1,64 @@
+package service
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestInjectedTransport(t *testing.T) {
+	var got *http.Request
+	rt := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		got = req
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(`{"ok":true}`)), Header: http.Header{}}, nil
+	})
+
+	h := NewHandler(&Config{HTTP: &HTTPConfig{UserAgent: "test-agent"}, SlackAPIURL: "http://fake.slack/api"}, nil, newMemoryStore(), WithTransport(rt)).(*handler)
+
+	req, _ := http.NewRequest(http.MethodGet, h.slackAPIURL()+"auth.test", nil)
+	clients, err := h.http()
+	if err != nil {
+		t.Fatalf("clients: %s", err)
+	}
+	if _, err := clients.slack.Do(req); err != nil {
+		t.Fatalf("do: %s", err)
+	}
+	if got.URL.String() != "http://fake.slack/api/auth.test" || got.Header.Get("User-Agent") != "test-agent" {
+		t.Errorf("unexpected request %s with agent %q", got.URL, got.Header.Get("User-Agent"))
+	}
+}
+
+func TestRotatingProxy(t *testing.T) {
+	proxy, err := rotatingProxy([]string{"http://one:8080", "socks5://two:1080"})
+	if err != nil {
+		t.Fatalf("proxy: %s", err)
+	}
+
+	var hosts []string
+	for i := 0; i < 3; i++ {
+		u, _ := proxy(nil)
+		hosts = append(hosts, u.Host)
+	}
+	if strings.Join(hosts, ",") != "one:8080,two:1080,one:8080" {
+		t.Errorf("unexpected rotation %v", hosts)
+	}
+
+	if _, err := rotatingProxy([]string{"ftp://nope"}); err == nil {
+		t.Errorf("expected unsupported scheme to fail")
+	}
+}
+
+func TestBadHTTPConfig(t *testing.T) {
+	h := NewHandler(&Config{HTTP: &HTTPConfig{Proxy: "ftp://nope"}}, nil, newMemoryStore()).(*handler)
+
+	if _, err := h.http(); err == nil || !isPermanent(err) {
+		t.Errorf("expected a permanent error, got %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+// Package slacktest is a fake Slack API for tests. It records web API
+// calls and posts to response urls, and can be told to fail them.
+package slacktest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Call is a request the fake received.
+type Call struct {
+	// Method is the web api method, e.g. "chat.unfurl", or "response_url"
+	// for posts to a response url.
+	Method string
+	Path   string
+	Header http.Header
+	// Form is set for form encoded requests, Body for everything else.
+	Form url.Values
+	Body []byte
+}
+
+// JSON decodes the call's body into v.
+func (c *Call) JSON(v interface{}) error {
+	return json.Unmarshal(c.Body, v)
+}
+
+// Token is the token the call was made with, from the Authorization
+// header or the form.
+func (c *Call) Token() string {
+	if auth := c.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return c.Form.Get("token")
+}
+
+type failure struct {
+	status int
+	err    string
+	times  int
+}
+
+// Server is a fake Slack served over TLS, since slash commands only accept
+// https response urls; use Client().Transport to reach it. Web api methods
+// are served under APIURL; unknown methods answer {"ok":true}.
+type Server struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	calls     []*Call
+	failures  map[string]*failure
+	responses map[string]interface{}
+}
+
+const responseURLPath = "/response/"
+
+func NewServer() *Server {
+	s := &Server{
+		failures: make(map[string]*failure),
+		responses: map[string]interface{}{
+			"oauth.v2.access": map[string]interface{}{
+				"ok":           true,
+				"access_token": "xoxb-test",
+				"token_type":   "bot",
+				"scope":        "commands,links:read,links:write",
+				"bot_user_id":  "UBOT",
+				"app_id":       "A1",
+				"team":         map[string]string{"id": "T1", "name": "Test Team"},
+			},
+			"auth.test": map[string]interface{}{
+				"ok":      true,
+				"team":    "Test Team",
+				"team_id": "T1",
+				"user_id": "UBOT",
+			},
+		},
+	}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// APIURL is the base url for web api methods, with a trailing slash.
+func (s *Server) APIURL() string {
+	return s.URL + "/api/"
+}
+
+// ResponseURL returns a response url for a slash command. Posts to it
+// are recorded as "response_url" calls.
+func (s *Server) ResponseURL(id string) string {
+	return s.URL + responseURLPath + id
+}
+
+// Respond sets the successful response body for method.
+func (s *Server) Respond(method string, body interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses[method] = body
+}
+
+// FailWith makes the next times calls to method answer ok:false with
+// the given slack error. times < 0 fails every call.
+func (s *Server) FailWith(method, slackError string, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[method] = &failure{status: http.StatusOK, err: slackError, times: times}
+}
+
+// FailStatus makes the next times calls to method answer with an http
+// error status. Use "response_url" for response url posts.
+func (s *Server) FailStatus(method string, status, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[method] = &failure{status: status, times: times}
+}
+
+// Calls returns the calls received so far, optionally only those for
+// the given methods.
+func (s *Server) Calls(methods ...string) []*Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var calls []*Call
+	for _, c := range s.calls {
+		if len(methods) == 0 {
+			calls = append(calls, c)
+			continue
+		}
+		for _, m := range methods {
+			if c.Method == m {
+				calls = append(calls, c)
+				break
+			}
+		}
+	}
+	return calls
+}
+
+// Reset forgets recorded calls and injected failures.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = nil
+	s.failures = make(map[string]*failure)
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	c := &Call{
+		Path:   r.URL.Path,
+		Header: r.Header.Clone(),
+	}
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/api/"):
+		c.Method = strings.TrimPrefix(r.URL.Path, "/api/")
+	case strings.HasPrefix(r.URL.Path, responseURLPath):
+		c.Method = "response_url"
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		c.Form, _ = url.ParseQuery(string(body))
+	} else {
+		c.Body = body
+	}
+
+	s.mu.Lock()
+	s.calls = append(s.calls, c)
+	f := s.failures[c.Method]
+	if f != nil {
+		if f.times > 0 {
+			f.times--
+		}
+		if f.times == 0 {
+			delete(s.failures, c.Method)
+		}
+	}
+	resp, ok := s.responses[c.Method]
+	s.mu.Unlock()
+
+	if f != nil && f.status != http.StatusOK {
+		w.WriteHeader(f.status)
+		return
+	}
+
+	if c.Method == "response_url" {
+		w.Write([]byte("ok"))
+		return
+	}
+
+	if f != nil {
+		resp = map[string]interface{}{"ok": false, "error": f.err}
+	} else if !ok {
+		resp = map[string]interface{}{"ok": true}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}